@@ -0,0 +1,112 @@
+package traefikumamitaginjector
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+)
+
+// ampAnalyticsSrc is the amp-analytics extension required before an <amp-analytics> element may be used.
+const ampAnalyticsSrc = "https://cdn.ampproject.org/v0/amp-analytics-0.1.js"
+
+// ampConfig is the inline configuration of the injected <amp-analytics> element.
+type ampConfig struct {
+	Requests  map[string]string     `json:"requests"`
+	Triggers  map[string]ampTrigger `json:"triggers"`
+	Transport ampTransport          `json:"transport"`
+}
+
+type ampTrigger struct {
+	On      string `json:"on"`
+	Request string `json:"request"`
+}
+
+type ampTransport struct {
+	Beacon  bool `json:"beacon"`
+	XHRPost bool `json:"xhrpost"`
+	Image   bool `json:"image"`
+}
+
+// isAMP reports whether the root <html> tag in lower carries the amp or ⚡ attribute.
+// lower must already be lowercased; an incomplete tag is not AMP (yet).
+func isAMP(lower []byte) bool {
+	i := bytes.Index(lower, []byte("<html"))
+	if i < 0 {
+		return false
+	}
+	start := i + len("<html")
+	end := tagEnd(lower, start)
+	if end < 0 || (start < len(lower) && !isTagSpace(lower[start]) && lower[start] != '>') {
+		return false
+	}
+
+	for _, field := range bytes.FieldsFunc(lower[start:end-1], func(r rune) bool { return r < 0x80 && isTagSpace(byte(r)) }) {
+		name := field
+		if eq := bytes.IndexByte(field, '='); eq >= 0 {
+			name = field[:eq]
+		}
+		name = bytes.TrimSuffix(name, []byte("/"))
+		if string(name) == "amp" || string(name) == "⚡" {
+			return true
+		}
+	}
+	return false
+}
+
+func isTagSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// ampHeadTag returns the amp-analytics extension script inserted before the head anchor.
+func ampHeadTag() []byte {
+	return []byte(`<script async custom-element="amp-analytics" src="` + ampAnalyticsSrc + `"></script>`)
+}
+
+// ampBodyTag returns the <amp-analytics> element inserted after <body>, or nil if AMP support is off.
+// The pageview goes to the pixel endpoint on the page's origin; AMP fills in ${...} when sending,
+// which keeps the host correct for pages served from an AMP cache.
+func (t *tracker) ampBodyTag() []byte {
+	if t.ampPixelPath == "" {
+		return nil
+	}
+
+	cfg := ampConfig{
+		Requests: map[string]string{
+			"pageview": "https://${sourceHost}" + t.ampPixelPath + "?w=" + url.QueryEscape(t.websiteID) +
+				"&u=${sourcePath}&r=${documentReferrer}",
+		},
+		Triggers: map[string]ampTrigger{
+			"trackPageview": {On: "visible", Request: "pageview"},
+		},
+		Transport: ampTransport{Image: true},
+	}
+	// json.Marshal escapes <, > and &, so the config can't close the script element.
+	raw, err := json.Marshal(cfg)
+	if err != nil {
+		return nil
+	}
+	return []byte(`<amp-analytics><script type="application/json">` + string(raw) + `</script></amp-analytics>`)
+}
+
+// tryInjectAMP inserts the amp-analytics extension before the head anchor (unless the page
+// loads it already) and the <amp-analytics> element right after <body>. AMP only allows
+// extension scripts in <head>, so there is no </body> fallback.
+func tryInjectAMP(prefix, lower []byte, d *document, t *tracker, injectBefore string) ([]byte, bool) {
+	if bytes.Contains(lower, []byte(asciiLower([]byte(t.ampPixelPath+"?")))) {
+		return nil, false
+	}
+
+	headIdx := bytes.Index(lower, asciiLower([]byte(injectBefore)))
+	bodyIdx := bodyOpenEnd(lower, "<body")
+	if headIdx < 0 || bodyIdx < 0 {
+		return nil, false
+	}
+
+	var insertions []insertion
+	if !bytes.Contains(lower, []byte(`custom-element="amp-analytics"`)) {
+		insertions = append(insertions, insertion{at: d.enc.offset(headIdx), snippet: d.enc.encode(ampHeadTag())})
+	}
+	insertions = append(insertions, insertion{at: d.enc.offset(bodyIdx), snippet: d.enc.encode(t.ampBodyTag())})
+
+	return splice(prefix, insertions), true
+}
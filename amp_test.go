@@ -0,0 +1,94 @@
+package traefikumamitaginjector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const ampPage = `<!doctype html><html ⚡ lang="en"><head><meta charset="utf-8"><title>t</title></head>` +
+	`<body><p>Hi</p></body></html>`
+
+func ampTestConfig() *Config {
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.AMPAnalytics = true
+	return cfg
+}
+
+func Test_AMP_InjectsAmpAnalytics(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/news", nil)
+	out := serveHTML(t, ampTestConfig(), req, ampPage, nil).Body.String()
+
+	mustContain(t, out, string(ampHeadTag())+"</head>", "amp-analytics extension should be loaded in <head>")
+	mustContain(t, out,
+		`<body><amp-analytics><script type="application/json">{"requests":{"pageview":"https://${sourceHost}/_umami/pixel?w=uuid\u0026u=${sourcePath}\u0026r=${documentReferrer}"},`+
+			`"triggers":{"trackPageview":{"on":"visible","request":"pageview"}},"transport":{"beacon":false,"xhrpost":false,"image":true}}</script></amp-analytics><p>`,
+		"<amp-analytics> should follow <body>")
+	mustNotContain(t, out, "script.js", "AMP pages must not get the regular script")
+}
+
+func Test_AMP_DetectsAmpAttribute(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/news", nil)
+	out := serveHTML(t, ampTestConfig(), req, `<html amp><head></head><body></body></html>`, nil).Body.String()
+
+	mustContain(t, out, "<amp-analytics>", "<html amp> is an AMP document")
+}
+
+func Test_AMP_KeepsExistingExtensionScript(t *testing.T) {
+	page := `<html ⚡><head><script async custom-element="amp-analytics" src="` + ampAnalyticsSrc + `"></script></head><body></body></html>`
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/news", nil)
+	out := serveHTML(t, ampTestConfig(), req, page, nil).Body.String()
+
+	mustContain(t, out, "<body><amp-analytics>", "element should still be added")
+	if got := len(out) - len(page); got != len(ampBodyTagFor(t, "uuid")) {
+		t.Fatalf("expected only the <amp-analytics> element to be added, body=%q", out)
+	}
+}
+
+func Test_AMP_PassesThroughWhenDisabled(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/news", nil)
+	if out := serveHTML(t, cfg, req, ampPage, nil).Body.String(); out != ampPage {
+		t.Fatalf("AMP pages must be left untouched without ampAnalytics, got %q", out)
+	}
+}
+
+func Test_AMP_AttributeValuesDoNotCount(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/news", nil)
+	out := serveHTML(t, ampTestConfig(), req, `<html lang="amp"><head></head><body></body></html>`, nil).Body.String()
+
+	mustContain(t, out, scriptSnippet("https://analytics.jubnl.ch/script.js", "uuid"), "regular pages get the script")
+	mustNotContain(t, out, "<amp-analytics>", "lang=amp is not an AMP marker")
+}
+
+func Test_AMP_EnablesPixelEndpoint(t *testing.T) {
+	umami := newUmamiStandIn(t)
+
+	cfg := ampTestConfig()
+	cfg.HostURL = umami.URL
+
+	mw := newTestMiddleware(t, http.NotFoundHandler(), cfg)
+
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/_umami/pixel?w=uuid&u=%2Fnews&r=https%3A%2F%2Fcdn.ampproject.org%2F", nil))
+
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "image/gif" {
+		t.Fatalf("expected the pixel endpoint to answer, got %d", rr.Code)
+	}
+
+	umami.waitForEvents(t, 1)
+	umami.mu.Lock()
+	defer umami.mu.Unlock()
+	if len(umami.events) != 1 || umami.events[0].Payload.Referrer != "https://cdn.ampproject.org/" {
+		t.Fatalf("expected one pageview with the AMP referrer, got %+v", umami.events)
+	}
+}
+
+func ampBodyTagFor(t *testing.T, websiteID string) []byte {
+	t.Helper()
+	return (&tracker{websiteID: websiteID, ampPixelPath: "/_umami/pixel"}).ampBodyTag()
+}
@@ -0,0 +1,132 @@
+package traefikumamitaginjector
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// responseAttributes turns upstream response headers into tracking data the page doesn't expose.
+type responseAttributes struct {
+	tagHeader    string            // value becomes data-tag
+	eventHeaders map[string]string // event property -> response header
+	eventName    string
+	strip        bool // remove the headers before they reach the client
+}
+
+// newResponseAttributes validates the response attribute settings of cfg.
+func newResponseAttributes(cfg *Config) (*responseAttributes, error) {
+	a := &responseAttributes{
+		tagHeader:    strings.TrimSpace(cfg.TagHeader),
+		eventHeaders: map[string]string{},
+		eventName:    strings.TrimSpace(cfg.EventName),
+		strip:        cfg.StripAttributeHeaders,
+	}
+	for prop, header := range cfg.EventHeaders {
+		if prop, header = strings.TrimSpace(prop), strings.TrimSpace(header); prop != "" && header != "" {
+			a.eventHeaders[prop] = header
+		}
+	}
+	if len(a.eventHeaders) > 0 && a.eventName == "" {
+		return nil, errors.New("eventHeaders requires eventName")
+	}
+	return a, nil
+}
+
+func (a *responseAttributes) enabled() bool {
+	return a != nil && (a.tagHeader != "" || len(a.eventHeaders) > 0)
+}
+
+// stripped lists the response headers to remove, or nil if they are kept.
+func (a *responseAttributes) stripped() []string {
+	if !a.enabled() || !a.strip {
+		return nil
+	}
+	var names []string
+	if a.tagHeader != "" {
+		names = append(names, a.tagHeader)
+	}
+	for _, header := range a.eventHeaders {
+		names = append(names, header)
+	}
+	return names
+}
+
+// readResponseAttributes copies the website ID and the configured attributes from the upstream
+// response headers into the tracker once, before the snippet is rendered, and extends the
+// variant so derived entity tags follow the values.
+func (w *streamWriter) readResponseAttributes() {
+	if w.attributesRead {
+		return
+	}
+	w.attributesRead = true
+
+	var upstreamID string
+	for _, r := range w.websiteIDResolvers {
+		if upstreamID = r.resolveResponse(w.header); upstreamID != "" {
+			w.tracker.websiteID = upstreamID
+			break
+		}
+	}
+
+	if w.attributes.enabled() {
+		w.readAttributeHeaders()
+	}
+
+	if upstreamID != "" || w.tracker.tag != "" || w.tracker.event != "" {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(upstreamID))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(w.tracker.tag))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(w.tracker.event))
+		w.variant += "." + strconv.FormatUint(uint64(h.Sum32()), 16)
+	}
+}
+
+// readAttributeHeaders renders data-tag and the track event from the configured headers.
+func (w *streamWriter) readAttributeHeaders() {
+	a := w.attributes
+	if a.tagHeader != "" {
+		w.tracker.tag = strings.TrimSpace(w.header.Get(a.tagHeader))
+	}
+
+	var props map[string]string
+	for prop, header := range a.eventHeaders {
+		if v := strings.TrimSpace(w.header.Get(header)); v != "" {
+			if props == nil {
+				props = map[string]string{}
+			}
+			props[prop] = v
+		}
+	}
+	if props != nil {
+		if raw, err := json.Marshal(props); err == nil {
+			name, _ := json.Marshal(a.eventName)
+			w.tracker.event = afterTrackerLoads(`umami.track(` + string(name) + `,` + string(raw) + `)`)
+		}
+	}
+}
+
+// stripResponseAttributes removes the website ID headers, and the attribute headers if
+// configured, from the response.
+func (w *streamWriter) stripResponseAttributes() {
+	for _, name := range w.websiteIDHeaders {
+		w.header.Del(name)
+	}
+
+	for _, name := range w.attributes.stripped() {
+		w.header.Del(name)
+	}
+}
+
+// eventTag returns the inline umami.track() call placed after the tracker, or nil.
+func (t *tracker) eventTag(d *document) []byte {
+	if t.event == "" {
+		return nil
+	}
+	script := d.qname("script")
+	return []byte(`<` + script + `>` + t.event + `</` + script + `>`)
+}
@@ -0,0 +1,127 @@
+package traefikumamitaginjector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func attributesConfig() *Config {
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.TagHeader = "X-Analytics-Tag"
+	cfg.EventHeaders = map[string]string{"experiment": "X-Experiment", "cache": "X-Cache"}
+	return cfg
+}
+
+func Test_ResponseAttributes_TagAndEvent(t *testing.T) {
+	rr := serveHTML(t, attributesConfig(), httptest.NewRequest(http.MethodGet, "https://example.com/", nil), helloPage, map[string]string{
+		"X-Analytics-Tag": `tenant "a"`,
+		"X-Experiment":    "checkout-b",
+	})
+
+	mustContain(t, rr.Body.String(),
+		`<script defer src="https://analytics.jubnl.ch/script.js" data-website-id="uuid" data-tag="tenant &#34;a&#34;"></script>`+
+			`<script>document.addEventListener("DOMContentLoaded",function(){if(window.umami)umami.track("page-context",{"experiment":"checkout-b"})})</script></head>`,
+		"data-tag and event should come from response headers")
+	if rr.Header().Get("X-Experiment") != "checkout-b" {
+		t.Fatalf("headers should be kept unless stripping is enabled")
+	}
+}
+
+func Test_ResponseAttributes_AbsentHeaders(t *testing.T) {
+	rr := serveHTML(t, attributesConfig(), httptest.NewRequest(http.MethodGet, "https://example.com/", nil), helloPage, nil)
+
+	mustContain(t, rr.Body.String(), scriptSnippet("https://analytics.jubnl.ch/script.js", "uuid")+"</head>",
+		"without the headers the plain snippet is injected")
+}
+
+func Test_ResponseAttributes_StripHeaders(t *testing.T) {
+	cfg := attributesConfig()
+	cfg.StripAttributeHeaders = true
+
+	rr := serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://example.com/", nil), helloPage, map[string]string{"X-Analytics-Tag": "a", "X-Cache": "HIT"})
+	for _, h := range []string{"X-Analytics-Tag", "X-Cache"} {
+		if rr.Header().Get(h) != "" {
+			t.Fatalf("%s should be stripped, got headers %v", h, rr.Header())
+		}
+	}
+	mustContain(t, rr.Body.String(), `data-tag="a"`, "values are still used")
+
+	// Stripped on passthrough too.
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("X-Cache", "HIT")
+		_, _ = rw.Write([]byte(`{}`))
+	})
+	rr = httptest.NewRecorder()
+	newTestMiddleware(t, next, cfg).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+	if rr.Header().Get("X-Cache") != "" {
+		t.Fatalf("X-Cache should be stripped from passthrough responses")
+	}
+}
+
+func Test_ResponseAttributes_StrippedOnBypass(t *testing.T) {
+	cfg := attributesConfig()
+	cfg.StripAttributeHeaders = true
+	cfg.AllowedHosts = []string{"example.com"}
+
+	requests := map[string]*http.Request{
+		"post":             httptest.NewRequest(http.MethodPost, "https://example.com/", nil),
+		"partial":          httptest.NewRequest(http.MethodGet, "https://example.com/", nil),
+		"fetch":            httptest.NewRequest(http.MethodGet, "https://example.com/", nil),
+		"host-not-allowed": httptest.NewRequest(http.MethodGet, "https://other.example/", nil),
+	}
+	requests["partial"].Header.Set("HX-Request", "true")
+	requests["fetch"].Header.Set("Sec-Fetch-Dest", "empty")
+
+	for name, req := range requests {
+		rr := serveHTML(t, cfg, req, helloPage, map[string]string{"X-Analytics-Tag": "secret", "X-Experiment": "a"})
+		if rr.Header().Get("X-Analytics-Tag") != "" || rr.Header().Get("X-Experiment") != "" {
+			t.Fatalf("%s: attribute headers should be stripped, got %v", name, rr.Header())
+		}
+		if rr.Body.String() != helloPage {
+			t.Fatalf("%s: bypassed body should be untouched, got %q", name, rr.Body.String())
+		}
+	}
+
+	// tagHeader can't be combined with sampling.
+	cfg.TagHeader = ""
+	cfg.SamplePercent = 0
+	rr := serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://example.com/", nil), helloPage,
+		map[string]string{"X-Experiment": "a"})
+	if rr.Header().Get("X-Experiment") != "" || rr.Body.String() != helloPage {
+		t.Fatalf("not-sampled: attribute headers should be stripped, got %v %q", rr.Header(), rr.Body.String())
+	}
+}
+
+func Test_ResponseAttributes_ExtendDerivedETag(t *testing.T) {
+	cfg := attributesConfig()
+
+	a := serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://example.com/", nil), helloPage, map[string]string{"ETag": `"v1"`, "X-Experiment": "a"}).Header().Get("ETag")
+	b := serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://example.com/", nil), helloPage, map[string]string{"ETag": `"v1"`, "X-Experiment": "b"}).Header().Get("ETag")
+	if a == b || !strings.HasPrefix(a, `W/"v1-umami-`) {
+		t.Fatalf("expected distinct derived tags per attribute value, got %q and %q", a, b)
+	}
+
+	// The extended tag still revalidates against the upstream tag.
+	var seen string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get("If-None-Match")
+		rw.Header().Set("ETag", `"v1"`)
+		rw.Header().Set("X-Experiment", "a")
+		rw.WriteHeader(http.StatusNotModified)
+	})
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.Header.Set("If-None-Match", a)
+	rr := httptest.NewRecorder()
+	newTestMiddleware(t, next, cfg).ServeHTTP(rr, req)
+
+	if seen != `"v1"` {
+		t.Fatalf("expected If-None-Match to be translated to the upstream tag, got %q", seen)
+	}
+	if rr.Code != http.StatusNotModified || rr.Header().Get("ETag") != a {
+		t.Fatalf("expected 304 with ETag %q, got %d %q", a, rr.Code, rr.Header().Get("ETag"))
+	}
+}
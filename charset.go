@@ -0,0 +1,212 @@
+package traefikumamitaginjector
+
+import (
+	"bytes"
+	"mime"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// textEncoding is the character encoding of a document, as far as injection cares.
+type textEncoding int
+
+const (
+	encUTF8 textEncoding = iota
+	// encASCIISuperset covers legacy encodings in which ASCII bytes always stand for ASCII
+	// characters (ISO-8859-x, windows-125x, Shift_JIS, EUC-*, GBK, Big5, ...).
+	encASCIISuperset
+	encUTF16LE
+	encUTF16BE
+	// encUnsupported documents are never modified.
+	encUnsupported
+)
+
+// asciiSupersetLabels lists charset labels (lowercase) of encodings in which markup and an
+// ASCII snippet can be matched and inserted byte-wise.
+var asciiSupersetLabels = map[string]bool{
+	"us-ascii": true, "ascii": true, "ansi_x3.4-1968": true,
+	"latin1": true, "l1": true, "cp819": true,
+	"koi8-r": true, "koi8-u": true, "koi8": true,
+	"shift_jis": true, "shift-jis": true, "sjis": true, "ms_kanji": true, "windows-31j": true, "csshiftjis": true, "x-sjis": true, "cp932": true,
+	"euc-jp": true, "x-euc-jp": true, "euc-kr": true, "cp949": true,
+	"gbk": true, "gb2312": true, "gb18030": true, "cp936": true, "x-gbk": true,
+	"big5": true, "big5-hkscs": true, "cn-big5": true, "x-x-big5": true,
+	"tis-620": true, "windows-874": true, "macintosh": true, "x-mac-roman": true, "x-mac-cyrillic": true,
+	"ibm866": true, "cp866": true,
+}
+
+// charsetEncoding maps a charset label to an encoding.
+func charsetEncoding(label string) textEncoding {
+	label = strings.ToLower(strings.Trim(strings.TrimSpace(label), `"'`))
+	switch {
+	case label == "utf-8" || label == "utf8" || label == "unicode-1-1-utf-8":
+		return encUTF8
+	case label == "utf-16" || label == "utf-16le" || label == "unicode" || label == "ucs-2":
+		return encUTF16LE
+	case label == "utf-16be" || label == "unicodefffe":
+		return encUTF16BE
+	case strings.HasPrefix(label, "iso-8859-") || strings.HasPrefix(label, "iso8859-") ||
+		strings.HasPrefix(label, "windows-125") || strings.HasPrefix(label, "cp125"):
+		return encASCIISuperset
+	case asciiSupersetLabels[label]:
+		return encASCIISuperset
+	}
+	return encUnsupported
+}
+
+// detectEncoding determines the document encoding from, in order of precedence, a byte order
+// mark, the Content-Type charset and a <meta> declaration in prefix. Documents with no
+// declaration are treated as UTF-8.
+func detectEncoding(contentType string, prefix []byte) textEncoding {
+	switch {
+	case bytes.HasPrefix(prefix, []byte{0xEF, 0xBB, 0xBF}):
+		return encUTF8
+	case bytes.HasPrefix(prefix, []byte{0xFF, 0xFE}):
+		return encUTF16LE
+	case bytes.HasPrefix(prefix, []byte{0xFE, 0xFF}):
+		return encUTF16BE
+	}
+
+	if _, params, err := mime.ParseMediaType(contentType); err == nil && params["charset"] != "" {
+		enc := charsetEncoding(params["charset"])
+		// "utf-16" without a BOM: tell the byte order from the first ASCII character.
+		if enc == encUTF16LE && len(prefix) >= 2 && prefix[0] == 0 && prefix[1] != 0 {
+			enc = encUTF16BE
+		}
+		return enc
+	}
+
+	if label := metaCharset(prefix); label != "" {
+		enc := charsetEncoding(label)
+		// A <meta> readable as ASCII cannot truthfully declare UTF-16 (HTML treats it as UTF-8).
+		if enc == encUTF16LE || enc == encUTF16BE {
+			return encUTF8
+		}
+		return enc
+	}
+
+	return encUTF8
+}
+
+// metaCharset returns the charset declared by <meta charset> or <meta http-equiv content> within
+// the first 1024 bytes of an ASCII-compatible document, or "".
+func metaCharset(prefix []byte) string {
+	if len(prefix) > 1024 {
+		prefix = prefix[:1024]
+	}
+	lower := asciiLower(prefix)
+
+	for from := 0; ; {
+		i := bytes.Index(lower[from:], []byte("<meta"))
+		if i < 0 {
+			return ""
+		}
+		start := from + i
+		end := tagEnd(lower, start+len("<meta"))
+		if end < 0 {
+			return ""
+		}
+		from = end
+
+		tag := lower[start:end]
+		j := bytes.Index(tag, []byte("charset"))
+		if j < 0 {
+			continue
+		}
+		rest := bytes.TrimLeft(tag[j+len("charset"):], " \t\r\n\f")
+		if len(rest) == 0 || rest[0] != '=' {
+			continue
+		}
+		rest = bytes.TrimLeft(rest[1:], " \t\r\n\f\"'")
+		k := bytes.IndexAny(rest, " \t\r\n\f\"'>;/")
+		if k < 0 {
+			k = len(rest)
+		}
+		if k > 0 {
+			return string(rest[:k])
+		}
+	}
+}
+
+// narrow returns one byte per character position of b: ASCII characters as themselves and
+// anything else as 0xFF. Searches for ASCII markup run on the narrowed text; offset maps a
+// position back into b.
+func (e textEncoding) narrow(b []byte) []byte {
+	if e != encUTF16LE && e != encUTF16BE {
+		return b
+	}
+
+	out := make([]byte, len(b)/2)
+	for i := range out {
+		hi, lo := b[2*i+1], b[2*i]
+		if e == encUTF16BE {
+			hi, lo = lo, hi
+		}
+		if hi == 0 && lo < utf8.RuneSelf {
+			out[i] = lo
+		} else {
+			out[i] = 0xFF
+		}
+	}
+	return out
+}
+
+// offset maps a position in the narrowed text to a byte offset in the document.
+func (e textEncoding) offset(i int) int {
+	if e == encUTF16LE || e == encUTF16BE {
+		return 2 * i
+	}
+	return i
+}
+
+// encode converts an injected snippet, written in UTF-8, to the document encoding.
+// Legacy encodings get non-ASCII characters as numeric character references.
+func (e textEncoding) encode(snippet []byte) []byte {
+	switch e {
+	case encUTF8:
+		return snippet
+	case encUTF16LE, encUTF16BE:
+		units := utf16.Encode([]rune(string(snippet)))
+		out := make([]byte, 0, 2*len(units))
+		for _, u := range units {
+			if e == encUTF16LE {
+				out = append(out, byte(u), byte(u>>8))
+			} else {
+				out = append(out, byte(u>>8), byte(u))
+			}
+		}
+		return out
+	default:
+		return asciiOnly(snippet)
+	}
+}
+
+// asciiOnly replaces non-ASCII characters with numeric character references.
+func asciiOnly(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for _, r := range string(b) {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+			continue
+		}
+		out = append(out, "&#x"...)
+		out = strconv.AppendInt(out, int64(r), 16)
+		out = append(out, ';')
+	}
+	return out
+}
+
+// asciiLower lowercases ASCII letters only, so offsets stay valid for any encoding.
+// (bytes.ToLower may change the length of non-ASCII or invalid UTF-8 input.)
+func asciiLower(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		out[i] = c
+	}
+	return out
+}
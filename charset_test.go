@@ -0,0 +1,159 @@
+package traefikumamitaginjector
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"unicode/utf16"
+)
+
+func encodeUTF16(s string, bigEndian, bom bool) []byte {
+	units := utf16.Encode([]rune(s))
+	if bom {
+		units = append([]uint16{0xFEFF}, units...)
+	}
+
+	out := make([]byte, 0, 2*len(units))
+	for _, u := range units {
+		if bigEndian {
+			out = append(out, byte(u>>8), byte(u))
+		} else {
+			out = append(out, byte(u), byte(u>>8))
+		}
+	}
+	return out
+}
+
+// serveBytes runs the middleware against an upstream returning body with the given Content-Type.
+func serveBytes(t *testing.T, contentType string, body []byte) []byte {
+	t.Helper()
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.NoscriptPixel = true
+
+	return serveBytesWith(t, cfg, contentType, body)
+}
+
+// serveBytesWith is serveBytes with a custom configuration.
+func serveBytesWith(t *testing.T, cfg *Config, contentType string, body []byte) []byte {
+	t.Helper()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		if contentType != "" {
+			rw.Header().Set("Content-Type", contentType)
+		}
+		_, _ = rw.Write(body)
+	})
+
+	rr := httptest.NewRecorder()
+	newTestMiddleware(t, next, cfg).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+	return rr.Body.Bytes()
+}
+
+const (
+	charsetPage     = "<html><head><title>Grüße – 日本語</title></head><body>Hallo</body></html>"
+	charsetInjected = "<html><head><title>Grüße – 日本語</title>" +
+		`<script defer src="https://analytics.jubnl.ch/script.js" data-website-id="uuid"></script>` +
+		"</head><body>" +
+		`<noscript><img src="/_umami/pixel?u=%2F&amp;w=uuid" alt="" width="1" height="1" style="display:none"></noscript>` +
+		"Hallo</body></html>"
+)
+
+func Test_Charset_UTF16LE_WithBOM(t *testing.T) {
+	got := serveBytes(t, "text/html", encodeUTF16(charsetPage, false, true))
+
+	if want := encodeUTF16(charsetInjected, false, true); !bytes.Equal(got, want) {
+		t.Fatalf("unexpected UTF-16LE output:\n got=%x\nwant=%x", got, want)
+	}
+}
+
+func Test_Charset_UTF16BE_FromContentType_WithoutBOM(t *testing.T) {
+	got := serveBytes(t, "text/html; charset=UTF-16BE", encodeUTF16(charsetPage, true, false))
+
+	if want := encodeUTF16(charsetInjected, true, false); !bytes.Equal(got, want) {
+		t.Fatalf("unexpected UTF-16BE output:\n got=%x\nwant=%x", got, want)
+	}
+}
+
+func Test_Charset_UTF16_Label_DetectsByteOrder(t *testing.T) {
+	got := serveBytes(t, "text/html; charset=utf-16", encodeUTF16(charsetPage, true, false))
+
+	if want := encodeUTF16(charsetInjected, true, false); !bytes.Equal(got, want) {
+		t.Fatalf("unexpected output for big-endian utf-16 without BOM:\n got=%x\nwant=%x", got, want)
+	}
+}
+
+func Test_Charset_UTF16_SniffedWithoutContentType(t *testing.T) {
+	got := serveBytes(t, "", encodeUTF16("<!DOCTYPE html>"+charsetPage, false, true))
+
+	if want := encodeUTF16("<!DOCTYPE html>"+charsetInjected, false, true); !bytes.Equal(got, want) {
+		t.Fatalf("unexpected output for sniffed UTF-16:\n got=%x\nwant=%x", got, want)
+	}
+}
+
+// "日本語" and "Ｈｅａｄ" in Shift_JIS. The second byte of 0x82 0x60 ("Ａ") etc. falls in the
+// ASCII letter range, which must not confuse matching or offsets.
+var shiftJISTitle = []byte{0x93, 0xfa, 0x96, 0x7b, 0x8c, 0xea, 0x20, 0x82, 0x67, 0x82, 0x85, 0x82, 0x81, 0x82, 0x84}
+
+func shiftJISPage(head string) []byte {
+	var b bytes.Buffer
+	b.WriteString("<html><head>" + head + "<title>")
+	b.Write(shiftJISTitle)
+	b.WriteString("</title></head><body>")
+	b.Write(shiftJISTitle)
+	b.WriteString("</body></html>")
+	return b.Bytes()
+}
+
+func shiftJISInjected(head string) []byte {
+	var b bytes.Buffer
+	b.WriteString("<html><head>" + head + "<title>")
+	b.Write(shiftJISTitle)
+	b.WriteString("</title>" + scriptSnippet("https://analytics.jubnl.ch/script.js", "uuid") + "</head><body>")
+	b.WriteString(`<noscript><img src="/_umami/pixel?u=%2F&amp;w=uuid" alt="" width="1" height="1" style="display:none"></noscript>`)
+	b.Write(shiftJISTitle)
+	b.WriteString("</body></html>")
+	return b.Bytes()
+}
+
+func Test_Charset_ShiftJIS_FromContentType(t *testing.T) {
+	got := serveBytes(t, "text/html; charset=Shift_JIS", shiftJISPage(""))
+
+	if want := shiftJISInjected(""); !bytes.Equal(got, want) {
+		t.Fatalf("unexpected Shift_JIS output:\n got=%q\nwant=%q", got, want)
+	}
+}
+
+func Test_Charset_ShiftJIS_FromMetaCharset(t *testing.T) {
+	head := `<meta http-equiv="Content-Type" content="text/html; charset=Shift_JIS">`
+	got := serveBytes(t, "text/html", shiftJISPage(head))
+
+	if want := shiftJISInjected(head); !bytes.Equal(got, want) {
+		t.Fatalf("unexpected Shift_JIS output:\n got=%q\nwant=%q", got, want)
+	}
+}
+
+func Test_Charset_Unsupported_PassesThrough(t *testing.T) {
+	for _, tc := range []struct {
+		contentType string
+		body        []byte
+	}{
+		{contentType: "text/html; charset=utf-32", body: []byte("<html><head></head></html>")},
+		{contentType: "text/html", body: []byte(`<html><head><meta charset="ISO-2022-JP"></head></html>`)},
+		{contentType: "text/html; charset=x-unknown", body: []byte("<html><head></head></html>")},
+	} {
+		got := serveBytes(t, tc.contentType, tc.body)
+		if !bytes.Equal(got, tc.body) {
+			t.Fatalf("%s: expected passthrough, got %q", tc.contentType, got)
+		}
+	}
+}
+
+func Test_Charset_LegacyEncoding_EscapesNonASCIISnippet(t *testing.T) {
+	got := encASCIISuperset.encode([]byte(`<script data-tag="café"></script>`))
+	if string(got) != `<script data-tag="caf&#xe9;"></script>` {
+		t.Fatalf("unexpected snippet encoding %q", got)
+	}
+}
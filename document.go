@@ -0,0 +1,70 @@
+package traefikumamitaginjector
+
+import (
+	"regexp"
+	"strings"
+)
+
+// document describes how a response body is written, which shapes the injected markup.
+type document struct {
+	enc textEncoding
+
+	// xhtml documents (application/xhtml+xml) are parsed as XML: attributes need values and
+	// <noscript> has no effect.
+	xhtml bool
+	// prefix is the namespace prefix bound to XHTML when the document doesn't use it as the
+	// default namespace, e.g. "h" for <h:html xmlns:h="http://www.w3.org/1999/xhtml">.
+	prefix string
+	// amp documents (<html amp> / <html ⚡>) only accept AMP components, see tryInjectAMP.
+	amp bool
+}
+
+// htmlDocument is a plain UTF-8 HTML document.
+var htmlDocument = &document{enc: encUTF8}
+
+var (
+	xhtmlDefaultNS  = regexp.MustCompile(`xmlns\s*=\s*["']http://www\.w3\.org/1999/xhtml["']`)
+	xhtmlPrefixedNS = regexp.MustCompile(`xmlns:([A-Za-z_][\w.-]*)\s*=\s*["']http://www\.w3\.org/1999/xhtml["']`)
+)
+
+// xhtmlPrefix returns the prefix bound to the XHTML namespace in text, or "" if XHTML is the
+// default namespace (or not declared at all).
+func xhtmlPrefix(text []byte) string {
+	if xhtmlDefaultNS.Match(text) {
+		return ""
+	}
+	if m := xhtmlPrefixedNS.FindSubmatch(text); m != nil {
+		return string(m[1])
+	}
+	return ""
+}
+
+// qname qualifies an HTML element name for the document.
+func (d *document) qname(local string) string {
+	if d.prefix == "" {
+		return local
+	}
+	return d.prefix + ":" + local
+}
+
+// qualifyTag rewrites a configured tag such as "</head>" for the document's namespace prefix.
+func (d *document) qualifyTag(tag string) string {
+	if d.prefix == "" {
+		return tag
+	}
+	if strings.HasPrefix(tag, "</") {
+		return "</" + d.qname(tag[2:])
+	}
+	if strings.HasPrefix(tag, "<") {
+		return "<" + d.qname(tag[1:])
+	}
+	return tag
+}
+
+// boolAttr renders a boolean attribute: bare in HTML, name="name" in XHTML.
+func (d *document) boolAttr(name string) string {
+	if d.xhtml {
+		return name + `="` + name + `"`
+	}
+	return name
+}
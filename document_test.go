@@ -0,0 +1,45 @@
+package traefikumamitaginjector
+
+import (
+	"testing"
+)
+
+const xhtmlScript = `<script defer="defer" src="https://analytics.jubnl.ch/script.js" data-website-id="uuid"></script>`
+
+func Test_XHTML_UsesXMLAttributes_AndSkipsNoscript(t *testing.T) {
+	page := `<?xml version="1.0" encoding="UTF-8"?>` +
+		`<html xmlns="http://www.w3.org/1999/xhtml"><head><title>t</title></head><body>Hi</body></html>`
+
+	out := string(serveBytes(t, "application/xhtml+xml; charset=utf-8", []byte(page)))
+
+	mustContain(t, out, xhtmlScript+"</head>", "XHTML should get an XML-valid script element")
+	mustNotContain(t, out, "<noscript>", "XHTML ignores <noscript>, no pixel should be added")
+}
+
+func Test_XHTML_PrefixedNamespace(t *testing.T) {
+	page := `<h:html xmlns:h="http://www.w3.org/1999/xhtml"><h:head><h:title>t</h:title></h:head>` +
+		`<h:body>Hi</h:body></h:html>`
+
+	out := string(serveBytes(t, "application/xhtml+xml", []byte(page)))
+
+	want := `<h:script defer="defer" src="https://analytics.jubnl.ch/script.js" data-website-id="uuid"></h:script></h:head>`
+	mustContain(t, out, want, "script should use the document's XHTML prefix")
+}
+
+func Test_XHTML_DefaultNamespaceWinsOverPrefix(t *testing.T) {
+	page := `<html xmlns="http://www.w3.org/1999/xhtml" xmlns:x="http://www.w3.org/1999/xhtml">` +
+		`<head></head><body></body></html>`
+
+	out := string(serveBytes(t, "application/xhtml+xml", []byte(page)))
+
+	mustContain(t, out, xhtmlScript+"</head>", "unprefixed elements are XHTML already")
+}
+
+func Test_HTML_KeepsBooleanAttribute(t *testing.T) {
+	page := `<html xmlns="http://www.w3.org/1999/xhtml"><head></head><body></body></html>`
+
+	out := string(serveBytes(t, "text/html", []byte(page)))
+
+	mustContain(t, out, scriptSnippet("https://analytics.jubnl.ch/script.js", "uuid")+"</head>",
+		"text/html is parsed as HTML even with an xmlns attribute")
+}
@@ -0,0 +1,84 @@
+package traefikumamitaginjector
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DataDomains values.
+const (
+	domainsHost      = "host"      // the canonical request host
+	domainsAllowlist = "allowlist" // the exact entries of allowedHosts
+)
+
+// parseDomains returns the normalized allowedHosts and the validated dataDomains mode.
+func parseDomains(cfg *Config) (allowedHosts []string, mode string, err error) {
+	for _, h := range cfg.AllowedHosts {
+		if h = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(h)), "."); h != "" {
+			allowedHosts = append(allowedHosts, h)
+		}
+	}
+
+	mode = strings.ToLower(strings.TrimSpace(cfg.DataDomains))
+	switch mode {
+	case "", domainsHost:
+	case domainsAllowlist:
+		if len(allowedHosts) == 0 {
+			return nil, "", fmt.Errorf("dataDomains %q requires allowedHosts", domainsAllowlist)
+		}
+	default:
+		return nil, "", fmt.Errorf("unknown dataDomains %q (want %q or %q)", cfg.DataDomains, domainsHost, domainsAllowlist)
+	}
+	return allowedHosts, mode, nil
+}
+
+// canonicalHost returns the host the visitor asked for: the first X-Forwarded-Host if a proxy
+// in front of Traefik set one, otherwise the Host header, lowercased and without port.
+func canonicalHost(req *http.Request) string {
+	host := req.Host
+	if fwd := req.Header.Get("X-Forwarded-Host"); fwd != "" {
+		host = strings.TrimSpace(strings.SplitN(fwd, ",", 2)[0])
+	}
+	return strings.TrimSuffix(strings.ToLower(hostWithoutPort(host)), ".")
+}
+
+// hostAllowed reports whether host matches an allowlist entry: an exact host, or "*.example.com"
+// for any subdomain of example.com. An empty allowlist allows every host.
+func hostAllowed(host string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, entry := range allowed {
+		if strings.HasPrefix(entry, "*.") {
+			if strings.HasSuffix(host, entry[1:]) {
+				return true
+			}
+		} else if host == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// dataDomains returns the data-domains value for a page served to host, or "" if disabled.
+func (m *Middleware) dataDomains(host string) string {
+	switch m.domainsMode {
+	case domainsHost:
+		return host
+	case domainsAllowlist:
+		var exact []string
+		for _, entry := range m.allowedHosts {
+			if !strings.HasPrefix(entry, "*.") {
+				exact = append(exact, entry)
+			}
+		}
+		// Wildcards can't be listed; the host that matched one stands in for it.
+		if !hostAllowed(host, exact) {
+			exact = append(exact, host)
+		}
+		return strings.Join(exact, ",")
+	default:
+		return ""
+	}
+}
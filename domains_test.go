@@ -0,0 +1,67 @@
+package traefikumamitaginjector
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_DataDomains_FromCanonicalHost(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.DataDomains = domainsHost
+
+	req := httptest.NewRequest(http.MethodGet, "http://backend.internal:8080/", nil)
+	req.Header.Set("X-Forwarded-Host", "WWW.Example.com:443, proxy.internal")
+	out := serveHTML(t, cfg, req, helloPage, nil).Body.String()
+	mustContain(t, out,
+		`<script defer src="https://analytics.jubnl.ch/script.js" data-website-id="uuid" data-domains="www.example.com"></script>`,
+		"data-domains should come from X-Forwarded-Host")
+
+	out = serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://shop.example.com/", nil), helloPage, nil).Body.String()
+	mustContain(t, out, `data-domains="shop.example.com"`, "Host is used without X-Forwarded-Host")
+}
+
+func Test_DataDomains_Allowlist(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.DataDomains = domainsAllowlist
+	cfg.AllowedHosts = []string{"example.com", "www.example.com", "*.shop.example.com"}
+
+	out := serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://example.com/", nil), helloPage, nil).Body.String()
+	mustContain(t, out, `data-domains="example.com,www.example.com"`, "exact entries are listed")
+	out = serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://eu.shop.example.com/", nil), helloPage, nil).Body.String()
+	mustContain(t, out, `data-domains="example.com,www.example.com,eu.shop.example.com"`, "a wildcard match adds the host itself")
+
+	for _, host := range []string{"https://staging.example.com/", "https://shop.example.com/", "https://example.com.evil.test/"} {
+		out = serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, host, nil), helloPage, nil).Body.String()
+		mustNotContain(t, out, cfg.ScriptSrc, host+" is outside the allowlist")
+	}
+}
+
+func Test_AllowedHosts_WithoutDataDomains(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.AllowedHosts = []string{"example.com"}
+
+	out := serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://example.com/", nil), helloPage, nil).Body.String()
+	mustContain(t, out, scriptSnippet(cfg.ScriptSrc, "uuid"), "allowed host without data-domains")
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.Header.Set("X-Forwarded-Host", "staging.example.com")
+	mustNotContain(t, serveHTML(t, cfg, req, helloPage, nil).Body.String(), cfg.ScriptSrc, "the forwarded host decides")
+}
+
+func Test_DataDomains_InvalidConfig(t *testing.T) {
+	for _, mutate := range []func(*Config){
+		func(c *Config) { c.DataDomains = "everything" },
+		func(c *Config) { c.DataDomains = domainsAllowlist },
+	} {
+		cfg := CreateConfig()
+		mutate(cfg)
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+			t.Fatalf("expected a configuration error for %+v", cfg)
+		}
+	}
+}
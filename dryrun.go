@@ -0,0 +1,39 @@
+package traefikumamitaginjector
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strings"
+)
+
+// decodedPrefix decompresses a copy of the buffered prefix of a response with the given
+// Content-Encoding, for a dry run to decide on what a real run would see uncompressed. At most
+// limit bytes are decoded; a truncated stream yields what could be decoded so far. ok is false
+// for encodings that can't be decoded here (br, zstd, stacked encodings).
+func decodedPrefix(encoding string, prefix []byte, limit int) (decoded []byte, ok bool) {
+	var r io.Reader
+	var err error
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(prefix))
+	case "deflate":
+		// deflate is zlib-wrapped per RFC 9110, but some servers send raw deflate.
+		r, err = zlib.NewReader(bytes.NewReader(prefix))
+		if errors.Is(err, zlib.ErrHeader) {
+			r, err = flate.NewReader(bytes.NewReader(prefix)), nil
+		}
+	default:
+		return nil, false
+	}
+	if err != nil {
+		// Not even the stream header is buffered yet.
+		return nil, true
+	}
+
+	decoded, _ = io.ReadAll(io.LimitReader(r, int64(limit)))
+	return decoded, true
+}
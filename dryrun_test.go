@@ -0,0 +1,146 @@
+package traefikumamitaginjector
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_DryRun_ForwardsOriginalResponse(t *testing.T) {
+	const page = "<html><head></head><body>Hello</body></html>"
+
+	var acceptEncoding, ifNoneMatch string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		acceptEncoding, ifNoneMatch = r.Header.Get("Accept-Encoding"), r.Header.Get("If-None-Match")
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		rw.Header().Set("Content-Length", "44")
+		rw.Header().Set("ETag", `"v1"`)
+		_, _ = rw.Write([]byte(page))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.DryRun = true
+	cfg.DebugHeader = "X-Umami-Injector"
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", `W/"v0-umami-x"`)
+	rr := httptest.NewRecorder()
+	newTestMiddleware(t, next, cfg).ServeHTTP(rr, req)
+
+	if rr.Body.String() != page {
+		t.Fatalf("dry run must not modify the body, got %q", rr.Body.String())
+	}
+	if rr.Header().Get("ETag") != `"v1"` || rr.Header().Get("Content-Length") != "44" {
+		t.Fatalf("dry run must not modify headers, got %v", rr.Header())
+	}
+	if acceptEncoding != "gzip" {
+		t.Fatalf("dry run must forward Accept-Encoding, upstream saw %q", acceptEncoding)
+	}
+	if ifNoneMatch != `W/"v0-umami-x"` {
+		t.Fatalf("dry run must not translate If-None-Match, upstream saw %q", ifNoneMatch)
+	}
+	if got := rr.Header().Get("X-Umami-Injector"); got != "inject; dry-run" {
+		t.Fatalf("expected the would-be outcome in the debug header, got %q", got)
+	}
+}
+
+func Test_DryRun_DecidesOnDecompressedCopy(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write([]byte("<html><head></head><body>Hello</body></html>"))
+	_ = zw.Close()
+	compressed := gz.Bytes()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		rw.Header().Set("Content-Encoding", "gzip")
+		// Split the stream so the first decision sees a truncated prefix.
+		_, _ = rw.Write(compressed[:5])
+		_, _ = rw.Write(compressed[5:])
+	})
+
+	for _, tc := range []struct {
+		stripAcceptEncoding bool
+		want                string
+	}{
+		{true, "inject; dry-run"},
+		{false, "skip; reason=compressed; dry-run"},
+	} {
+		cfg := CreateConfig()
+		cfg.WebsiteID = "uuid"
+		cfg.DryRun = true
+		cfg.DebugHeader = "X-Umami-Injector"
+		cfg.StripAcceptEncoding = tc.stripAcceptEncoding
+
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		newTestMiddleware(t, next, cfg).ServeHTTP(rr, req)
+
+		if !bytes.Equal(rr.Body.Bytes(), compressed) {
+			t.Fatalf("dry run must forward the compressed body untouched")
+		}
+		if got := rr.Header().Get("X-Umami-Injector"); got != tc.want {
+			t.Fatalf("stripAcceptEncoding=%v: expected %q, got %q", tc.stripAcceptEncoding, tc.want, got)
+		}
+	}
+}
+
+func Test_DebugHeader_ReportsOutcome(t *testing.T) {
+	cases := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		want        string
+	}{
+		{"injected", http.MethodGet, "text/html", "<html><head></head><body></body></html>", "inject"},
+		{"not html", http.MethodGet, "application/json", "{}", "skip; reason=not-html"},
+		{"duplicate", http.MethodGet, "text/html", `<html><head><script src="https://analytics.jubnl.ch/script.js"></script></head></html>`, "skip; reason=duplicate"},
+		{"no anchor", http.MethodGet, "text/html", "<p>fragment</p>", "skip; reason=no-anchor"},
+		{"method", http.MethodPost, "text/html", "<html><head></head></html>", "skip; reason=method"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				rw.Header().Set("Content-Type", tc.contentType)
+				_, _ = rw.Write([]byte(tc.body))
+			})
+
+			cfg := CreateConfig()
+			cfg.WebsiteID = "uuid"
+			cfg.DebugHeader = "X-Umami-Injector"
+
+			rr := httptest.NewRecorder()
+			newTestMiddleware(t, next, cfg).ServeHTTP(rr, httptest.NewRequest(tc.method, "https://example.com/", nil))
+
+			if got := rr.Header().Get("X-Umami-Injector"); got != tc.want {
+				t.Fatalf("expected debug header %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func Test_DryRun_Head(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		rw.Header().Set("Content-Length", "44")
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.DryRun = true
+	cfg.DebugHeader = "X-Umami-Injector"
+
+	rr := httptest.NewRecorder()
+	newTestMiddleware(t, next, cfg).ServeHTTP(rr, httptest.NewRequest(http.MethodHead, "https://example.com/", nil))
+
+	if rr.Header().Get("Content-Length") != "44" || rr.Header().Get("X-Umami-Injector") != "skip; reason=head; dry-run" {
+		t.Fatalf("expected untouched HEAD headers, reported as not decided, got %v", rr.Header())
+	}
+}
@@ -0,0 +1,119 @@
+package traefikumamitaginjector
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Environment routes matching requests to another Umami instance. An environment matches when
+// every condition it sets holds; the first matching one wins.
+type Environment struct {
+	Name string `json:"name,omitempty"`
+
+	HostPattern string `json:"hostPattern,omitempty"` // regexp on the canonical host
+	Header      string `json:"header,omitempty"`      // request header to inspect
+	HeaderValue string `json:"headerValue,omitempty"` // expected value (case-insensitive); empty = any non-empty value
+
+	ScriptSrc      string `json:"scriptSrc,omitempty"`      // tracker URL of this instance
+	HostURL        string `json:"hostUrl,omitempty"`        // data-host-url and pixel collector; the collector defaults to the origin of ScriptSrc
+	WebsiteID      string `json:"websiteId,omitempty"`      // overrides the resolved website ID if set
+	FrameWebsiteID string `json:"frameWebsiteId,omitempty"` // iframe documents with frameHandling "separate"; defaults to WebsiteID
+}
+
+// environment is a validated Environment.
+type environment struct {
+	name           string
+	host           *regexp.Regexp
+	header         string
+	headerValue    string
+	scriptSrc      string
+	dataHostURL    string // rendered as data-host-url, empty if not configured
+	collector      string // where pixel hits are reported
+	websiteID      string
+	frameWebsiteID string
+}
+
+func newEnvironments(cfg *Config) ([]environment, error) {
+	needCollector := cfg.NoscriptPixel || cfg.AMPAnalytics
+	frames := strings.EqualFold(strings.TrimSpace(cfg.FrameHandling), frameSeparate)
+	provisioned := false
+	for _, r := range cfg.WebsiteIDResolvers {
+		provisioned = provisioned || strings.EqualFold(strings.TrimSpace(r.Type), resolveUmami)
+	}
+
+	envs := make([]environment, 0, len(cfg.Environments))
+	for i, spec := range cfg.Environments {
+		name := strings.TrimSpace(spec.Name)
+		if name == "" {
+			name = fmt.Sprintf("environments[%d]", i)
+		}
+
+		env := environment{
+			name:        name,
+			header:      strings.TrimSpace(spec.Header),
+			headerValue: strings.TrimSpace(spec.HeaderValue),
+			scriptSrc:   strings.TrimSpace(spec.ScriptSrc),
+			dataHostURL: strings.TrimRight(strings.TrimSpace(spec.HostURL), "/"),
+			websiteID:   strings.TrimSpace(spec.WebsiteID),
+		}
+		env.frameWebsiteID = strings.TrimSpace(spec.FrameWebsiteID)
+		if env.frameWebsiteID == "" {
+			env.frameWebsiteID = env.websiteID
+		}
+		if env.scriptSrc == "" {
+			return nil, fmt.Errorf("%s: scriptSrc is required", name)
+		}
+		env.collector = env.dataHostURL
+		if env.collector == "" {
+			env.collector = originOf(env.scriptSrc)
+		}
+		if p := strings.TrimSpace(spec.HostPattern); p != "" {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid hostPattern: %w", name, err)
+			}
+			env.host = re
+		}
+		if needCollector && env.collector == "" {
+			return nil, fmt.Errorf("%s: noscriptPixel and ampAnalytics require hostUrl or an absolute scriptSrc", name)
+		}
+		if env.headerValue != "" && env.header == "" {
+			return nil, fmt.Errorf("%s: headerValue requires header", name)
+		}
+		// The top-level IDs belong to the top-level instance.
+		if provisioned && env.websiteID == "" {
+			return nil, fmt.Errorf("%s: websiteId is required with the umami resolver, which provisions on the top-level hostUrl", name)
+		}
+		if frames && env.frameWebsiteID == "" {
+			return nil, fmt.Errorf("%s: frameHandling %q requires websiteId or frameWebsiteId", name, frameSeparate)
+		}
+
+		envs = append(envs, env)
+	}
+	return envs, nil
+}
+
+func (e *environment) matches(req *http.Request, host string) bool {
+	if e.host != nil && !e.host.MatchString(host) {
+		return false
+	}
+	if e.header != "" {
+		v := strings.TrimSpace(req.Header.Get(e.header))
+		if v == "" || (e.headerValue != "" && !strings.EqualFold(v, e.headerValue)) {
+			return false
+		}
+	}
+	return true
+}
+
+// environment returns the first environment matching req, or nil to use the top-level settings.
+func (m *Middleware) environment(req *http.Request, host string) *environment {
+	for i := range m.environments {
+		if m.environments[i].matches(req, host) {
+			return &m.environments[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package traefikumamitaginjector
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func environmentsConfig() *Config {
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid-prod"
+	cfg.ScriptSrc = "https://umami.example.com/script.js"
+	cfg.Environments = []Environment{
+		{
+			Name:        "dev",
+			Header:      "X-Env",
+			HeaderValue: "dev",
+			ScriptSrc:   "https://umami.dev.example.com/script.js",
+			WebsiteID:   "uuid-dev",
+		},
+		{
+			Name:        "staging",
+			HostPattern: `^staging\.`,
+			ScriptSrc:   "https://cdn.example.com/umami/script.js",
+			HostURL:     "https://umami.staging.example.com",
+			WebsiteID:   "uuid-staging",
+		},
+	}
+	return cfg
+}
+
+func Test_Environments_SwapTrackerAsASet(t *testing.T) {
+	cfg := environmentsConfig()
+
+	out := serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://staging.example.com/", nil), helloPage, nil).Body.String()
+	mustContain(t, out,
+		`<script defer src="https://cdn.example.com/umami/script.js" data-website-id="uuid-staging" data-host-url="https://umami.staging.example.com"></script>`,
+		"staging host should use the staging instance")
+
+	out = serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://www.example.com/", nil), helloPage, nil).Body.String()
+	mustContain(t, out,
+		scriptSnippet("https://umami.example.com/script.js", "uuid-prod"),
+		"other hosts keep the top-level settings")
+}
+
+func Test_Environments_ByHeader(t *testing.T) {
+	cfg := environmentsConfig()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		_, _ = rw.Write([]byte("<html><head></head></html>"))
+	})
+	mw := newTestMiddleware(t, next, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "https://staging.example.com/", nil)
+	req.Header.Set("X-Env", "DEV")
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, req)
+
+	mustContain(t, rr.Body.String(), scriptSnippet("https://umami.dev.example.com/script.js", "uuid-dev"),
+		"first matching environment wins")
+}
+
+func Test_Environments_PixelUsesEnvironmentCollector(t *testing.T) {
+	prod := newUmamiStandIn(t)
+	staging := newUmamiStandIn(t)
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.NoscriptPixel = true
+	cfg.HostURL = prod.URL
+	cfg.Environments = []Environment{{HostPattern: `^staging\.`, ScriptSrc: staging.URL + "/script.js"}}
+
+	mw := newTestMiddleware(t, http.NotFoundHandler(), cfg)
+	for _, host := range []string{"www.example.com", "staging.example.com"} {
+		rr := httptest.NewRecorder()
+		mw.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://"+host+"/_umami/pixel?w=uuid&u=%2F", nil))
+	}
+
+	prod.waitForEvents(t, 1)
+	staging.waitForEvents(t, 1)
+	prod.mu.Lock()
+	staging.mu.Lock()
+	defer prod.mu.Unlock()
+	defer staging.mu.Unlock()
+	if len(prod.events) != 1 || len(staging.events) != 1 || staging.events[0].Payload.Hostname != "staging.example.com" {
+		t.Fatalf("expected one hit per instance, got prod=%+v staging=%+v", prod.events, staging.events)
+	}
+}
+
+func Test_Environments_FramesStayWithTheirInstance(t *testing.T) {
+	cfg := environmentsConfig()
+	cfg.FrameHandling = frameSeparate
+	cfg.FrameWebsiteID = "uuid-prod-frames"
+	cfg.Environments[0].FrameWebsiteID = "uuid-dev-frames"
+
+	frame := func(host, env string) string {
+		req := httptest.NewRequest(http.MethodGet, "https://"+host+"/", nil)
+		req.Header.Set("Sec-Fetch-Dest", "iframe")
+		if env != "" {
+			req.Header.Set("X-Env", env)
+		}
+		return websiteIDIn(serveHTML(t, cfg, req, helloPage, nil).Body.String())
+	}
+
+	if got := frame("www.example.com", ""); got != "uuid-prod-frames" {
+		t.Fatalf("top-level frames should use frameWebsiteId, got %q", got)
+	}
+	if got := frame("www.example.com", "dev"); got != "uuid-dev-frames" {
+		t.Fatalf("environment frames should use the environment's frameWebsiteId, got %q", got)
+	}
+	if got := frame("staging.example.com", ""); got != "uuid-staging" {
+		t.Fatalf("environment frames should fall back to the environment's websiteId, got %q", got)
+	}
+}
+
+func Test_Environments_InvalidConfig(t *testing.T) {
+	for _, env := range []Environment{
+		{Name: "no-script"},
+		{ScriptSrc: "/script.js", HostPattern: "("},
+		{ScriptSrc: "/script.js", HeaderValue: "dev"},
+	} {
+		cfg := CreateConfig()
+		cfg.Environments = []Environment{env}
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+			t.Fatalf("expected environment %+v to be rejected", env)
+		}
+	}
+}
+
+func Test_Environments_RequireTheirOwnIDs(t *testing.T) {
+	for name, mutate := range map[string]func(*Config){
+		"umami resolver": func(c *Config) {
+			c.HostURL = "https://umami.example.com"
+			c.UmamiUsername, c.UmamiPassword = "admin", "umami"
+			c.ProvisionHostPattern = `\.example\.com$`
+			c.WebsiteIDResolvers = []WebsiteIDResolver{{Type: resolveUmami}}
+		},
+		"separate frames": func(c *Config) {
+			c.FrameHandling = frameSeparate
+			c.FrameWebsiteID = "uuid-frames"
+		},
+	} {
+		cfg := CreateConfig()
+		mutate(cfg)
+		cfg.Environments = []Environment{{HostPattern: `^staging\.`, ScriptSrc: "https://umami.staging.example.com/script.js"}}
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+			t.Fatalf("%s: an environment without websiteId must be rejected", name)
+		}
+
+		cfg.Environments[0].WebsiteID = "uuid-staging"
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err != nil {
+			t.Fatalf("%s: an environment with websiteId should be accepted: %v", name, err)
+		}
+	}
+}
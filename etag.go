@@ -0,0 +1,85 @@
+package traefikumamitaginjector
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// etagMarker separates the upstream opaque tag from the variant in derived entity tags.
+const etagMarker = "-umami-"
+
+// snippetVariant fingerprints everything that shapes the injected markup, so derived entity
+// tags change whenever the rewrite of an unchanged upstream body would.
+func snippetVariant(t *tracker, injectBefore string, alsoMatchBodyClose bool) string {
+	h := fnv.New32a()
+	_, _ = h.Write(t.scriptTag(htmlDocument))
+	_, _ = h.Write(t.identifyTag(htmlDocument))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write(t.noscriptTag(htmlDocument))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write(t.ampBodyTag())
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(strings.ToLower(injectBefore)))
+	if alsoMatchBodyClose {
+		_, _ = h.Write([]byte{1})
+	}
+	return strconv.FormatUint(uint64(h.Sum32()), 16)
+}
+
+// derivedETag returns the weak entity tag of the injected representation whose upstream
+// representation is tagged upstream, or "" if upstream is not a valid entity tag.
+// The result is weak: the body is semantically, not byte-for-byte, the upstream one.
+func derivedETag(upstream, variant string) string {
+	opaque, ok := opaqueTag(upstream)
+	if !ok {
+		return ""
+	}
+	return `W/"` + opaque + etagMarker + variant + `"`
+}
+
+// opaqueTag returns the quoted-string content of an entity tag, weak or strong.
+func opaqueTag(tag string) (string, bool) {
+	tag = strings.TrimSpace(tag)
+	tag = strings.TrimPrefix(tag, "W/")
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return "", false
+	}
+	return tag[1 : len(tag)-1], true
+}
+
+// translateIfNoneMatch maps derived entity tags in an If-None-Match value back to the upstream
+// tags they were derived from, so the upstream can evaluate the condition. Tags derived for a
+// different variant are dropped: the client's copy no longer matches what would be served.
+// Other tags are kept. It returns the new value and whether any tag for variant was translated.
+func translateIfNoneMatch(value, variant string) (string, bool) {
+	if strings.TrimSpace(value) == "*" {
+		return value, false
+	}
+
+	translated := false
+	var out []string
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+
+		opaque, ok := opaqueTag(tag)
+		i := strings.LastIndex(opaque, etagMarker)
+		if !ok || !strings.HasPrefix(tag, "W/") || i < 0 {
+			out = append(out, tag)
+			continue
+		}
+
+		// Response attributes extend the variant as "<variant>.<attributes>"; they are only
+		// known once the upstream answers, which then decides by its own tag.
+		if v := opaque[i+len(etagMarker):]; v != variant && !strings.HasPrefix(v, variant+".") {
+			continue
+		}
+		out = append(out, `"`+opaque[:i]+`"`)
+		translated = true
+	}
+
+	return strings.Join(out, ", "), translated
+}
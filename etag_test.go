@@ -0,0 +1,137 @@
+package traefikumamitaginjector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// etagUpstream serves an HTML page tagged "v1" and honors If-None-Match like a typical origin.
+func etagUpstream(sawIfNoneMatch *string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		*sawIfNoneMatch = r.Header.Get("If-None-Match")
+
+		rw.Header().Set("ETag", `"v1"`)
+		rw.Header().Set("Content-Type", "text/html")
+		if strings.Contains(r.Header.Get("If-None-Match"), `"v1"`) {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = rw.Write([]byte("<html><head></head><body></body></html>"))
+	})
+}
+
+func Test_ETag_DerivedOnInjection(t *testing.T) {
+	var saw string
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+
+	mw := newTestMiddleware(t, etagUpstream(&saw), cfg)
+
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+	etag := rr.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `W/"v1-umami-`) {
+		t.Fatalf("expected derived weak ETag, got %q", etag)
+	}
+
+	rr2 := httptest.NewRecorder()
+	mw.ServeHTTP(rr2, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+	if rr2.Header().Get("ETag") != etag {
+		t.Fatalf("expected deterministic ETag, got %q then %q", etag, rr2.Header().Get("ETag"))
+	}
+}
+
+func Test_ETag_RevalidationRoundTrip(t *testing.T) {
+	var saw string
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+
+	mw := newTestMiddleware(t, etagUpstream(&saw), cfg)
+
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+	etag := rr.Header().Get("ETag")
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+
+	mw.ServeHTTP(rr, req)
+
+	if saw != `"v1"` {
+		t.Fatalf("expected If-None-Match translated to upstream tag, upstream saw %q", saw)
+	}
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", rr.Code)
+	}
+	if rr.Header().Get("ETag") != etag {
+		t.Fatalf("expected 304 to carry the derived ETag %q, got %q", etag, rr.Header().Get("ETag"))
+	}
+}
+
+func Test_ETag_StaleVariant_IsNotRevalidated(t *testing.T) {
+	var saw string
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid-new"
+
+	mw := newTestMiddleware(t, etagUpstream(&saw), cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.Header.Set("If-None-Match", `W/"v1-umami-deadbeef"`)
+	rr := httptest.NewRecorder()
+
+	mw.ServeHTTP(rr, req)
+
+	if saw != "" {
+		t.Fatalf("expected stale derived tag dropped, upstream saw %q", saw)
+	}
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected full 200 after config change, got %d", rr.Code)
+	}
+	mustContain(t, rr.Body.String(), `data-website-id="uuid-new"`, "expected fresh injection")
+}
+
+func Test_ETag_UpstreamTagsPassThroughUntranslated(t *testing.T) {
+	var saw string
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+
+	mw := newTestMiddleware(t, etagUpstream(&saw), cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	rr := httptest.NewRecorder()
+
+	mw.ServeHTTP(rr, req)
+
+	if saw != `"v1"` {
+		t.Fatalf("expected foreign tag forwarded as-is, upstream saw %q", saw)
+	}
+	if rr.Code != http.StatusNotModified || rr.Header().Get("ETag") != `"v1"` {
+		t.Fatalf("expected upstream 304 untouched, got %d %q", rr.Code, rr.Header().Get("ETag"))
+	}
+}
+
+func Test_TranslateIfNoneMatch(t *testing.T) {
+	tests := []struct {
+		in         string
+		want       string
+		translated bool
+	}{
+		{in: "*", want: "*"},
+		{in: `"a"`, want: `"a"`},
+		{in: `W/"a-umami-v1"`, want: `"a"`, translated: true},
+		{in: `W/"a-umami-v0", "b", W/"c-umami-v1"`, want: `"b", "c"`, translated: true},
+		{in: `W/"a-umami-v0"`, want: ""},
+	}
+
+	for _, tt := range tests {
+		got, translated := translateIfNoneMatch(tt.in, "v1")
+		if got != tt.want || translated != tt.translated {
+			t.Fatalf("translateIfNoneMatch(%q) = %q, %v; want %q, %v", tt.in, got, translated, tt.want, tt.translated)
+		}
+	}
+}
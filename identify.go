@@ -0,0 +1,105 @@
+package traefikumamitaginjector
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// parseIdentify validates the user identification settings and returns the cleaned up user
+// header and session properties.
+func parseIdentify(cfg *Config) (userHeader string, properties map[string]string, err error) {
+	userHeader = strings.TrimSpace(cfg.IdentifyUserHeader)
+	if userHeader != "" && cfg.IdentifySecret == "" {
+		return "", nil, errors.New("identifyUserHeader requires identifySecret")
+	}
+	properties = map[string]string{}
+	for prop, header := range cfg.IdentifyProperties {
+		if prop, header = strings.TrimSpace(prop), strings.TrimSpace(header); prop != "" && header != "" {
+			properties[prop] = header
+		}
+	}
+	return userHeader, properties, nil
+}
+
+// identity returns the pseudonymous user ID and session properties for req, or ok=false if
+// identification is off or the user header is absent. The raw user ID never leaves this function.
+func (m *Middleware) identity(req *http.Request) (id string, props map[string]string, ok bool) {
+	if m.identifyUserHeader == "" {
+		return "", nil, false
+	}
+	user := strings.TrimSpace(req.Header.Get(m.identifyUserHeader))
+	if user == "" {
+		return "", nil, false
+	}
+
+	mac := hmac.New(sha256.New, m.identifySecret)
+	_, _ = mac.Write([]byte(user))
+	id = hex.EncodeToString(mac.Sum(nil))
+
+	for prop, header := range m.identifyProperties {
+		if v := strings.TrimSpace(req.Header.Get(header)); v != "" {
+			if props == nil {
+				props = map[string]string{}
+			}
+			props[prop] = v
+		}
+	}
+	return id, props, true
+}
+
+// identifyScript renders the inline umami.identify() call for an identity. It runs once the
+// deferred tracker has loaded; json.Marshal escapes <, > and &, which keeps the values inert
+// in both HTML and XHTML.
+func identifyScript(id string, props map[string]string) (string, error) {
+	args, err := json.Marshal(id)
+	if err != nil {
+		return "", err
+	}
+	if len(props) > 0 {
+		raw, err := json.Marshal(props)
+		if err != nil {
+			return "", err
+		}
+		args = append(append(args, ','), raw...)
+	}
+	return afterTrackerLoads(`umami.identify(` + string(args) + `)`), nil
+}
+
+// afterTrackerLoads wraps an umami call so it runs once the deferred tracker has been executed.
+func afterTrackerLoads(call string) string {
+	return `document.addEventListener("DOMContentLoaded",function(){if(window.umami)` + call + `})`
+}
+
+// identifyTag returns the inline identify script placed after the tracker, or nil.
+func (t *tracker) identifyTag(d *document) []byte {
+	if t.identify == "" {
+		return nil
+	}
+	script := d.qname("script")
+	return []byte(`<` + script + `>` + t.identify + `</` + script + `>`)
+}
+
+// privateCacheControl makes a Cache-Control value unusable for shared caches: pages carrying a
+// per-user identify call must not be served to someone else.
+func privateCacheControl(value string) string {
+	var out []string
+	for _, directive := range strings.Split(value, ",") {
+		directive = strings.TrimSpace(directive)
+		name := strings.ToLower(strings.SplitN(directive, "=", 2)[0])
+		switch name {
+		case "":
+			continue
+		case "private", "no-store":
+			return value
+		case "public", "s-maxage":
+			continue
+		}
+		out = append(out, directive)
+	}
+	return strings.Join(append(out, "private"), ", ")
+}
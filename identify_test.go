@@ -0,0 +1,103 @@
+package traefikumamitaginjector
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func identifyConfig() *Config {
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.IdentifyUserHeader = "X-Forwarded-User"
+	cfg.IdentifySecret = "s3cret"
+	cfg.IdentifyProperties = map[string]string{"group": "X-Forwarded-Groups", "plan": "X-Plan"}
+	return cfg
+}
+
+func Test_Identify_InjectsHashedUserAndProperties(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.Header.Set("X-Forwarded-User", "alice@example.com")
+	req.Header.Set("X-Forwarded-Groups", "admins</script>")
+	rr := serveHTML(t, identifyConfig(), req, helloPage, map[string]string{"Cache-Control": "public, max-age=60, s-maxage=600"})
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte("alice@example.com"))
+	hashed := hex.EncodeToString(mac.Sum(nil))
+
+	body := rr.Body.String()
+	mustContain(t, body,
+		scriptSnippet("https://analytics.jubnl.ch/script.js", "uuid")+
+			`<script>document.addEventListener("DOMContentLoaded",function(){if(window.umami)umami.identify("`+hashed+
+			`",{"group":"admins\u003c/script\u003e"})})</script></head>`,
+		"identify call should follow the tracker")
+	mustNotContain(t, body, "alice", "raw user ID must never be sent")
+
+	if got := rr.Header().Get("Cache-Control"); got != "max-age=60, private" {
+		t.Fatalf("expected a private Cache-Control, got %q", got)
+	}
+}
+
+func Test_Identify_AnonymousVisitor(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.Header.Set("X-Forwarded-Groups", "admins")
+	rr := serveHTML(t, identifyConfig(), req, helloPage, map[string]string{"Cache-Control": "public, max-age=60"})
+
+	mustContain(t, rr.Body.String(), scriptSnippet("https://analytics.jubnl.ch/script.js", "uuid")+"</head>",
+		"anonymous visitors get the plain tracker")
+	mustNotContain(t, rr.Body.String(), "identify", "no identify call without a user")
+	if got := rr.Header().Get("Cache-Control"); got != "public, max-age=60" {
+		t.Fatalf("Cache-Control should be untouched for anonymous pages, got %q", got)
+	}
+}
+
+func Test_Identify_DifferentUsersGetDifferentETags(t *testing.T) {
+	cfg := identifyConfig()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		rw.Header().Set("ETag", `"v1"`)
+		_, _ = rw.Write([]byte("<html><head></head><body></body></html>"))
+	})
+	mw := newTestMiddleware(t, next, cfg)
+
+	etagFor := func(user string) string {
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		req.Header.Set("X-Forwarded-User", user)
+		rr := httptest.NewRecorder()
+		mw.ServeHTTP(rr, req)
+		return rr.Header().Get("ETag")
+	}
+
+	if a, b := etagFor("alice"), etagFor("bob"); a == b {
+		t.Fatalf("expected per-user entity tags, both were %q", a)
+	}
+}
+
+func Test_Identify_RequiresSecret(t *testing.T) {
+	cfg := identifyConfig()
+	cfg.IdentifySecret = ""
+
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Fatalf("expected identifyUserHeader without identifySecret to be rejected")
+	}
+}
+
+func Test_PrivateCacheControl(t *testing.T) {
+	cases := map[string]string{
+		"":                          "private",
+		"no-cache":                  "no-cache, private",
+		"public, max-age=300":       "max-age=300, private",
+		"private, max-age=300":      "private, max-age=300",
+		"no-store":                  "no-store",
+		"max-age=10, S-Maxage=3600": "max-age=10, private",
+	}
+	for in, want := range cases {
+		if got := privateCacheControl(in); got != want {
+			t.Fatalf("privateCacheControl(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package traefikumamitaginjector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// transparentGIF is a 1x1 transparent GIF served by the pixel endpoint.
+var transparentGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// umamiEvent is the body of an Umami /api/send request.
+type umamiEvent struct {
+	Type    string       `json:"type"`
+	Payload umamiPayload `json:"payload"`
+}
+
+type umamiPayload struct {
+	Website  string `json:"website"`
+	Hostname string `json:"hostname"`
+	URL      string `json:"url"`
+	Referrer string `json:"referrer,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+// parsePixelPath validates the pixel endpoint, needed by noscriptPixel and ampAnalytics, which
+// report to the Umami instance at hostURL.
+func parsePixelPath(cfg *Config, hostURL string) (string, error) {
+	pixelPath := strings.TrimSpace(cfg.PixelPath)
+	if !cfg.NoscriptPixel && !cfg.AMPAnalytics {
+		return pixelPath, nil
+	}
+	if hostURL == "" {
+		return "", errors.New("noscriptPixel and ampAnalytics require hostUrl or an absolute scriptSrc")
+	}
+	if !strings.HasPrefix(pixelPath, "/") {
+		return "", errors.New("pixelPath must be an absolute path")
+	}
+	return pixelPath, nil
+}
+
+// pixelSrc builds the pixel URL for the page at requestURI.
+// The page URL is carried in the query because the pixel request itself only has the page as
+// its Referer. The page's own referrer is deliberately left out: the markup must depend on the
+// URL alone to stay cacheable under a single ETag.
+func pixelSrc(pixelPath, websiteID, requestURI string) string {
+	q := url.Values{}
+	q.Set("w", websiteID)
+	q.Set("u", requestURI)
+	return pixelPath + "?" + q.Encode()
+}
+
+// servePixel answers a noscript pixel hit with a transparent GIF and reports it to Umami
+// as a pageview. The report is sent in the background, bounded by the client timeout, so a
+// slow Umami never holds the visitor's connection. Delivery errors are ignored: the pixel
+// must render regardless.
+func (m *Middleware) servePixel(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var pageview *http.Request
+	q := req.URL.Query()
+	if websiteID := strings.TrimSpace(q.Get("w")); websiteID != "" && req.Method == http.MethodGet {
+		pageview = m.pageviewRequest(req, websiteID, q.Get("u"), q.Get("r"))
+	}
+
+	h := rw.Header()
+	h.Set("Content-Type", "image/gif")
+	h.Set("Content-Length", strconv.Itoa(len(transparentGIF)))
+	h.Set("Cache-Control", "no-store, max-age=0")
+	rw.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodGet {
+		_, _ = rw.Write(transparentGIF)
+	}
+
+	if pageview != nil {
+		go m.sendPageview(pageview)
+	}
+}
+
+// pageviewRequest builds the /api/send request reporting a pixel hit, or returns nil. It is
+// built up front: req must not be read once the handler has returned.
+func (m *Middleware) pageviewRequest(req *http.Request, websiteID, pageURL, referrer string) *http.Request {
+	if pageURL == "" {
+		pageURL = "/"
+	}
+	host := canonicalHost(req)
+
+	body, err := json.Marshal(umamiEvent{
+		Type: "event",
+		Payload: umamiPayload{
+			Website:  websiteID,
+			Hostname: host,
+			URL:      pageURL,
+			Referrer: referrer,
+			Language: primaryLanguage(req.Header.Get("Accept-Language")),
+		},
+	})
+	if err != nil {
+		return nil
+	}
+
+	collector := m.hostURL
+	if env := m.environment(req, host); env != nil {
+		collector = env.collector
+	}
+
+	// Detached from the request, which is done by the time the pageview is sent.
+	out, err := http.NewRequestWithContext(context.Background(), http.MethodPost, collector+"/api/send", bytes.NewReader(body))
+	if err != nil {
+		return nil
+	}
+	out.Header.Set("Content-Type", "application/json")
+	// Umami derives device, browser and location from these.
+	out.Header.Set("User-Agent", req.UserAgent())
+	if ip := clientIP(req); ip != "" {
+		out.Header.Set("X-Forwarded-For", ip)
+	}
+	return out
+}
+
+func (m *Middleware) sendPageview(out *http.Request) {
+	resp, err := m.client.Do(out)
+	if err != nil {
+		return
+	}
+	_ = resp.Body.Close()
+}
+
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// primaryLanguage returns the first language tag of an Accept-Language header.
+func primaryLanguage(acceptLanguage string) string {
+	first := strings.SplitN(acceptLanguage, ",", 2)[0]
+	return strings.TrimSpace(strings.SplitN(first, ";", 2)[0])
+}
+
+// clientIP returns the originating client address, preferring the first X-Forwarded-For hop.
+func clientIP(req *http.Request) string {
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		return strings.TrimSpace(strings.SplitN(xff, ",", 2)[0])
+	}
+	return hostWithoutPort(req.RemoteAddr)
+}
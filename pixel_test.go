@@ -0,0 +1,292 @@
+package traefikumamitaginjector
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// umamiStandIn is a minimal local replacement for an Umami instance.
+type umamiStandIn struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	events []umamiEvent
+	agents []string
+	ips    []string
+}
+
+func newUmamiStandIn(t *testing.T) *umamiStandIn {
+	t.Helper()
+
+	u := &umamiStandIn{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/send" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var ev umamiEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		u.mu.Lock()
+		u.events = append(u.events, ev)
+		u.agents = append(u.agents, r.UserAgent())
+		u.ips = append(u.ips, r.Header.Get("X-Forwarded-For"))
+		u.mu.Unlock()
+
+		_, _ = io.WriteString(rw, `{"ok":true}`)
+	}))
+	t.Cleanup(u.Close)
+
+	return u
+}
+
+// waitForEvents waits until n pageviews arrived; they are reported in the background.
+func (u *umamiStandIn) waitForEvents(t *testing.T, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		u.mu.Lock()
+		got := len(u.events)
+		u.mu.Unlock()
+		if got >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d events sent to umami, got %d", n, got)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func Test_NoscriptPixel_InsertedAfterBodyOpen(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		_, _ = rw.Write([]byte(`<html><head></head><body class="a>b">Hello</body></html>`))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.NoscriptPixel = true
+
+	mw := newTestMiddleware(t, next, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/docs?a=1", nil)
+	req.Header.Set("Referer", "https://search.example/")
+	rr := httptest.NewRecorder()
+
+	mw.ServeHTTP(rr, req)
+
+	body := rr.Body.String()
+	mustContain(t, body, scriptSnippet(cfg.ScriptSrc, "uuid")+"</head>", "script should still be injected before </head>")
+	mustContain(t, body,
+		`<body class="a>b"><noscript><img src="/_umami/pixel?u=%2Fdocs%3Fa%3D1&amp;w=uuid" alt="" width="1" height="1" style="display:none"></noscript>Hello`,
+		"pixel should follow the <body> open tag")
+}
+
+func Test_NoscriptPixel_WaitsForBodyOpenInLaterChunk(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		_, _ = rw.Write([]byte("<html><head><title>t</title></head><bo"))
+		_, _ = rw.Write([]byte("dy>Hello</body></html>"))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.NoscriptPixel = true
+
+	mw := newTestMiddleware(t, next, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	rr := httptest.NewRecorder()
+
+	mw.ServeHTTP(rr, req)
+
+	body := rr.Body.String()
+	if strings.Count(body, cfg.ScriptSrc) != 1 {
+		t.Fatalf("expected exactly one script, got body=%q", body)
+	}
+	mustContain(t, body, "<body><noscript><img", "pixel should be injected once <body> arrives")
+}
+
+func Test_NoscriptPixel_ScriptOnly_WhenBodyNeverArrives(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		_, _ = rw.Write([]byte("<html><head></head></html>"))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.NoscriptPixel = true
+
+	mw := newTestMiddleware(t, next, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	rr := httptest.NewRecorder()
+
+	mw.ServeHTTP(rr, req)
+
+	body := rr.Body.String()
+	mustContain(t, body, scriptSnippet(cfg.ScriptSrc, "uuid"), "script should be injected at finish")
+	mustNotContain(t, body, "<noscript>", "no <body> => no pixel")
+}
+
+func Test_NoscriptPixel_Disabled_ByDefault(t *testing.T) {
+	called := false
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		called = true
+		rw.Header().Set("Content-Type", "text/html")
+		_, _ = rw.Write([]byte("<html><head></head><body></body></html>"))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+
+	mw := newTestMiddleware(t, next, cfg)
+
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+	mustNotContain(t, rr.Body.String(), "<noscript>", "pixel is opt-in")
+
+	rr = httptest.NewRecorder()
+	mw.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/_umami/pixel", nil))
+	if !called {
+		t.Fatalf("pixel path should reach upstream when the pixel is disabled")
+	}
+}
+
+func Test_PixelEndpoint_SendsPageviewToUmami(t *testing.T) {
+	umami := newUmamiStandIn(t)
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		t.Fatalf("pixel requests must not reach upstream")
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.NoscriptPixel = true
+	cfg.HostURL = umami.URL
+
+	mw := newTestMiddleware(t, next, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com:8443/_umami/pixel?w=uuid&u=%2Fdocs%3Fa%3D1&r=https%3A%2F%2Fsearch.example%2F", nil)
+	req.Header.Set("User-Agent", "Lynx/2.9")
+	req.Header.Set("Accept-Language", "de-CH,de;q=0.9")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+	rr := httptest.NewRecorder()
+
+	mw.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "image/gif" {
+		t.Fatalf("expected 200 image/gif, got %d %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	if !bytes.Equal(rr.Body.Bytes(), transparentGIF) {
+		t.Fatalf("expected transparent gif body")
+	}
+
+	umami.waitForEvents(t, 1)
+	umami.mu.Lock()
+	defer umami.mu.Unlock()
+
+	if len(umami.events) != 1 {
+		t.Fatalf("expected one event sent to umami, got %d", len(umami.events))
+	}
+
+	want := umamiEvent{
+		Type: "event",
+		Payload: umamiPayload{
+			Website:  "uuid",
+			Hostname: "example.com",
+			URL:      "/docs?a=1",
+			Referrer: "https://search.example/",
+			Language: "de-CH",
+		},
+	}
+	if umami.events[0] != want {
+		t.Fatalf("unexpected event: got %+v want %+v", umami.events[0], want)
+	}
+	if umami.agents[0] != "Lynx/2.9" || umami.ips[0] != "203.0.113.7" {
+		t.Fatalf("expected client UA and IP forwarded, got %q %q", umami.agents[0], umami.ips[0])
+	}
+}
+
+func Test_PixelEndpoint_ReportsCanonicalHost(t *testing.T) {
+	umami := newUmamiStandIn(t)
+
+	cfg := CreateConfig()
+	cfg.NoscriptPixel = true
+	cfg.HostURL = umami.URL
+
+	mw := newTestMiddleware(t, http.NotFoundHandler(), cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "http://backend.internal:8080/_umami/pixel?w=uuid&u=%2F", nil)
+	req.Header.Set("X-Forwarded-Host", "WWW.Example.com")
+	mw.ServeHTTP(httptest.NewRecorder(), req)
+
+	umami.waitForEvents(t, 1)
+	umami.mu.Lock()
+	defer umami.mu.Unlock()
+	if got := umami.events[0].Payload.Hostname; got != "www.example.com" {
+		t.Fatalf("expected the forwarded host, got %q", got)
+	}
+}
+
+func Test_PixelEndpoint_StillServesGIF_WhenUmamiDown(t *testing.T) {
+	umami := newUmamiStandIn(t)
+	umami.Close()
+
+	cfg := CreateConfig()
+	cfg.NoscriptPixel = true
+	cfg.HostURL = umami.URL
+
+	mw := newTestMiddleware(t, http.NotFoundHandler(), cfg)
+
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/_umami/pixel?w=uuid&u=%2F", nil))
+
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), transparentGIF) {
+		t.Fatalf("expected gif despite collector failure, got %d", rr.Code)
+	}
+}
+
+func Test_PixelEndpoint_DoesNotWaitForUmami(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		<-release
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(release) })
+
+	cfg := CreateConfig()
+	cfg.NoscriptPixel = true
+	cfg.HostURL = slow.URL
+
+	mw := newTestMiddleware(t, http.NotFoundHandler(), cfg)
+
+	done := make(chan struct{})
+	rr := httptest.NewRecorder()
+	go func() {
+		mw.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/_umami/pixel?w=uuid&u=%2F", nil))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("pixel response waited for the collector")
+	}
+	if !bytes.Equal(rr.Body.Bytes(), transparentGIF) {
+		t.Fatalf("expected transparent gif body")
+	}
+}
@@ -0,0 +1,285 @@
+package traefikumamitaginjector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// provisionErrorTTL is how long a failed lookup is remembered, so a broken Umami isn't hit
+// on every request.
+const provisionErrorTTL = time.Minute
+
+// provisioner maps hosts to Umami websites through the Umami API, creating missing ones.
+type provisioner struct {
+	apiURL     string
+	username   string
+	password   string
+	hosts      *regexp.Regexp // nil = any host; New requires it or allowedHosts
+	ttl        time.Duration
+	lookupOnly bool // dry run: find existing websites but never create one
+	client     *http.Client
+	now        func() time.Time
+
+	mu        sync.Mutex
+	token     string
+	sites     map[string]*provisionedSite
+	nextSweep time.Time // when expired entries are next removed from sites
+}
+
+// provisionedSite is a cache entry; ready is closed once id and expires are set.
+type provisionedSite struct {
+	ready   chan struct{}
+	id      string
+	expires time.Time
+}
+
+type umamiWebsite struct {
+	ID     string `json:"id"`
+	Name   string `json:"name,omitempty"`
+	Domain string `json:"domain"`
+}
+
+// newProvisioner validates the provisioning settings of cfg for the Umami API at hostURL.
+func newProvisioner(cfg *Config, hostURL string, client *http.Client) (*provisioner, error) {
+	if hostURL == "" || cfg.UmamiUsername == "" || cfg.UmamiPassword == "" {
+		return nil, errors.New("umami resolver requires hostUrl, umamiUsername and umamiPassword")
+	}
+	p := &provisioner{
+		apiURL:     hostURL,
+		username:   cfg.UmamiUsername,
+		password:   cfg.UmamiPassword,
+		ttl:        time.Hour,
+		lookupOnly: cfg.DryRun,
+		client:     client,
+		now:        time.Now,
+		sites:      map[string]*provisionedSite{},
+	}
+	if v := strings.TrimSpace(cfg.ProvisionTTL); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid provisionTtl %q", cfg.ProvisionTTL)
+		}
+		p.ttl = ttl
+	}
+	if v := strings.TrimSpace(cfg.ProvisionHostPattern); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid provisionHostPattern: %w", err)
+		}
+		p.hosts = re
+	}
+	// Otherwise any Host header could create a website.
+	if p.hosts == nil && len(cfg.AllowedHosts) == 0 {
+		return nil, errors.New("umami resolver requires provisionHostPattern or allowedHosts")
+	}
+	return p, nil
+}
+
+// websiteID returns the website ID for host, or "" if host is not provisioned and can't be.
+// Concurrent requests for the same host share one lookup.
+func (p *provisioner) websiteID(ctx context.Context, host string) string {
+	host = strings.ToLower(host)
+	if host == "" || (p.hosts != nil && !p.hosts.MatchString(host)) {
+		return ""
+	}
+
+	p.mu.Lock()
+	site := p.sites[host]
+	if site != nil {
+		select {
+		case <-site.ready:
+			if p.now().After(site.expires) {
+				site = nil
+			}
+		default:
+		}
+	}
+	if site != nil {
+		p.mu.Unlock()
+		select {
+		case <-site.ready:
+			return site.id
+		case <-ctx.Done():
+			return ""
+		}
+	}
+	p.evictExpired()
+	site = &provisionedSite{ready: make(chan struct{})}
+	p.sites[host] = site
+	p.mu.Unlock()
+
+	// Detached from the request: other requests wait for this lookup too.
+	id, err := p.lookupOrCreate(context.Background(), host)
+	site.id = id
+	site.expires = p.now().Add(p.ttl)
+	if err != nil {
+		site.expires = p.now().Add(provisionErrorTTL)
+	}
+	close(site.ready)
+	return id
+}
+
+// evictExpired removes expired entries, at most once per TTL, so hosts that are never requested
+// again don't stay in memory. p.mu must be held.
+func (p *provisioner) evictExpired() {
+	now := p.now()
+	if now.Before(p.nextSweep) {
+		return
+	}
+	p.nextSweep = now.Add(p.ttl)
+
+	for host, site := range p.sites {
+		select {
+		case <-site.ready:
+			if now.After(site.expires) {
+				delete(p.sites, host)
+			}
+		default:
+		}
+	}
+}
+
+// lookupOrCreate finds the website whose domain is host, creating it if there is none unless
+// lookupOnly is set.
+func (p *provisioner) lookupOrCreate(ctx context.Context, host string) (string, error) {
+	var found []umamiWebsite
+	if err := p.call(ctx, http.MethodGet, "/api/websites?search="+url.QueryEscape(host), nil, &found); err != nil {
+		return "", err
+	}
+	for _, w := range found {
+		if strings.EqualFold(w.Domain, host) && w.ID != "" {
+			return w.ID, nil
+		}
+	}
+	if p.lookupOnly {
+		return "", nil
+	}
+
+	var created umamiWebsite
+	if err := p.call(ctx, http.MethodPost, "/api/websites", umamiWebsite{Name: host, Domain: host}, &created); err != nil {
+		return "", err
+	}
+	if created.ID == "" {
+		return "", errors.New("umami: created website has no id")
+	}
+	return created.ID, nil
+}
+
+// call performs an authenticated API request, logging in first and again once if the token expired.
+func (p *provisioner) call(ctx context.Context, method, path string, in, out interface{}) error {
+	token, err := p.authToken(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.do(ctx, method, path, token, in)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		_ = resp.Body.Close()
+		if token, err = p.authToken(ctx, true); err != nil {
+			return err
+		}
+		if resp, err = p.do(ctx, method, path, token, in); err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("umami: %s %s: %s", method, path, resp.Status)
+	}
+	return decodeUmami(resp, out)
+}
+
+// decodeUmami decodes an API response into out. Website lists come either as a bare array or,
+// in newer Umami versions, paginated as {"data": [...]}.
+func decodeUmami(resp *http.Response, out interface{}) error {
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return fmt.Errorf("umami: decoding response: %w", err)
+	}
+	if list, ok := out.(*[]umamiWebsite); ok && len(raw) > 0 && raw[0] == '{' {
+		var page struct {
+			Data []umamiWebsite `json:"data"`
+		}
+		if err := json.Unmarshal(raw, &page); err != nil {
+			return fmt.Errorf("umami: decoding response: %w", err)
+		}
+		*list = page.Data
+		return nil
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return fmt.Errorf("umami: decoding response: %w", err)
+	}
+	return nil
+}
+
+func (p *provisioner) do(ctx context.Context, method, path, token string, in interface{}) (*http.Response, error) {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.apiURL+path, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return p.client.Do(req)
+}
+
+// authToken returns the cached API token, logging in if there is none or refresh is set.
+func (p *provisioner) authToken(ctx context.Context, refresh bool) (string, error) {
+	p.mu.Lock()
+	token := p.token
+	p.mu.Unlock()
+	if token != "" && !refresh {
+		return token, nil
+	}
+
+	resp, err := p.do(ctx, http.MethodPost, "/api/auth/login", "", map[string]string{
+		"username": p.username,
+		"password": p.password,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("umami: login: %s", resp.Status)
+	}
+	var login struct {
+		Token string `json:"token"`
+	}
+	if err := decodeUmami(resp, &login); err != nil {
+		return "", err
+	}
+	if login.Token == "" {
+		return "", errors.New("umami: login returned no token")
+	}
+
+	p.mu.Lock()
+	p.token = login.Token
+	p.mu.Unlock()
+	return login.Token, nil
+}
@@ -0,0 +1,287 @@
+package traefikumamitaginjector
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// umamiAPIStandIn is a minimal local replacement for the Umami REST API.
+type umamiAPIStandIn struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	token    string
+	websites []umamiWebsite
+	logins   int
+	searches int
+	creates  int
+	paged    bool // answer lists as {"data": [...]}
+}
+
+func newUmamiAPIStandIn(t *testing.T) *umamiAPIStandIn {
+	t.Helper()
+
+	u := &umamiAPIStandIn{token: "token-1"}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+
+		if r.URL.Path == "/api/auth/login" && r.Method == http.MethodPost {
+			var creds map[string]string
+			_ = json.NewDecoder(r.Body).Decode(&creds)
+			if creds["username"] != "admin" || creds["password"] != "umami" {
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			u.logins++
+			_ = json.NewEncoder(rw).Encode(map[string]string{"token": u.token})
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer "+u.token {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch {
+		case r.URL.Path == "/api/websites" && r.Method == http.MethodGet:
+			u.searches++
+			search := r.URL.Query().Get("search")
+			found := []umamiWebsite{}
+			for _, w := range u.websites {
+				if strings.Contains(w.Domain, search) {
+					found = append(found, w)
+				}
+			}
+			if u.paged {
+				_ = json.NewEncoder(rw).Encode(map[string]interface{}{"data": found, "count": len(found)})
+				return
+			}
+			_ = json.NewEncoder(rw).Encode(found)
+		case r.URL.Path == "/api/websites" && r.Method == http.MethodPost:
+			u.creates++
+			var w umamiWebsite
+			_ = json.NewDecoder(r.Body).Decode(&w)
+			w.ID = "created-" + w.Domain
+			u.websites = append(u.websites, w)
+			_ = json.NewEncoder(rw).Encode(w)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(u.Close)
+
+	return u
+}
+
+func provisionConfig(api *umamiAPIStandIn) *Config {
+	cfg := CreateConfig()
+	cfg.HostURL = api.URL
+	cfg.UmamiUsername = "admin"
+	cfg.UmamiPassword = "umami"
+	cfg.WebsiteIDResolvers = []WebsiteIDResolver{{Type: resolveUmami}}
+	cfg.ProvisionHostPattern = `\.example\.com$`
+	return cfg
+}
+
+func Test_Provision_FindsExistingWebsite(t *testing.T) {
+	api := newUmamiAPIStandIn(t)
+	api.paged = true
+	api.websites = []umamiWebsite{
+		{ID: "uuid-blog-staging", Domain: "staging.blog.example.com"},
+		{ID: "uuid-blog", Domain: "blog.example.com"},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "https://Blog.example.com/", nil)
+	if got := websiteIDIn(serveHTML(t, provisionConfig(api), req, helloPage, nil).Body.String()); got != "uuid-blog" {
+		t.Fatalf("expected the existing website, got %q", got)
+	}
+	if api.creates != 0 {
+		t.Fatalf("existing websites must not be recreated")
+	}
+}
+
+func Test_Provision_CreatesAndCaches(t *testing.T) {
+	api := newUmamiAPIStandIn(t)
+	cfg := provisionConfig(api)
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		_, _ = rw.Write([]byte("<html><head></head></html>"))
+	})
+	mw := newTestMiddleware(t, next, cfg)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			mw.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://shop.example.com/", nil))
+			mustContain(t, rr.Body.String(), scriptSnippet(cfg.ScriptSrc, "created-shop.example.com"), "new host should be provisioned")
+		}()
+	}
+	wg.Wait()
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if api.logins != 1 || api.searches != 1 || api.creates != 1 {
+		t.Fatalf("expected one login, search and create, got %d/%d/%d", api.logins, api.searches, api.creates)
+	}
+}
+
+func Test_Provision_TTLAndRelogin(t *testing.T) {
+	api := newUmamiAPIStandIn(t)
+	api.websites = []umamiWebsite{{ID: "uuid-docs", Domain: "docs.example.com"}}
+
+	now := time.Unix(0, 0)
+	p := &provisioner{
+		apiURL:   api.URL,
+		username: "admin",
+		password: "umami",
+		ttl:      time.Hour,
+		client:   http.DefaultClient,
+		now:      func() time.Time { return now },
+		sites:    map[string]*provisionedSite{},
+	}
+
+	ctx := context.Background()
+	if id := p.websiteID(ctx, "docs.example.com"); id != "uuid-docs" {
+		t.Fatalf("got %q", id)
+	}
+	now = now.Add(30 * time.Minute)
+	_ = p.websiteID(ctx, "docs.example.com")
+	if api.searches != 1 {
+		t.Fatalf("expected a cached answer within the TTL, got %d searches", api.searches)
+	}
+
+	// Token expired on the Umami side: log in again transparently.
+	api.mu.Lock()
+	api.token = "token-2"
+	api.mu.Unlock()
+	now = now.Add(time.Hour)
+	if id := p.websiteID(ctx, "docs.example.com"); id != "uuid-docs" || api.searches != 2 || api.logins != 2 {
+		t.Fatalf("expected a fresh lookup after the TTL with a new login, got %q (%d searches, %d logins)", id, api.searches, api.logins)
+	}
+}
+
+func Test_Provision_FailureFallsThrough(t *testing.T) {
+	api := newUmamiAPIStandIn(t)
+	cfg := provisionConfig(api)
+	cfg.UmamiPassword = "wrong"
+	cfg.DefaultWebsiteID = "uuid-default"
+	cfg.WebsiteIDResolvers = append(cfg.WebsiteIDResolvers, WebsiteIDResolver{Type: resolveDefault})
+
+	req := httptest.NewRequest(http.MethodGet, "https://shop.example.com/", nil)
+	if got := websiteIDIn(serveHTML(t, cfg, req, helloPage, nil).Body.String()); got != "uuid-default" {
+		t.Fatalf("expected the next resolver when the API fails, got %q", got)
+	}
+}
+
+func Test_Provision_HostPattern(t *testing.T) {
+	api := newUmamiAPIStandIn(t)
+	cfg := provisionConfig(api)
+
+	req := httptest.NewRequest(http.MethodGet, "https://evil.test/", nil)
+	if got := websiteIDIn(serveHTML(t, cfg, req, helloPage, nil).Body.String()); got != "" || api.creates != 0 {
+		t.Fatalf("hosts outside provisionHostPattern must not be provisioned, got %q", got)
+	}
+}
+
+func Test_Provision_RequiresCredentials(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.WebsiteIDResolvers = []WebsiteIDResolver{{Type: resolveUmami}}
+
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Fatalf("expected the umami resolver without credentials to be rejected")
+	}
+}
+
+func Test_Provision_RequiresHostRestriction(t *testing.T) {
+	api := newUmamiAPIStandIn(t)
+	cfg := provisionConfig(api)
+	cfg.ProvisionHostPattern = ""
+
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Fatalf("expected the umami resolver without provisionHostPattern or allowedHosts to be rejected")
+	}
+
+	cfg.AllowedHosts = []string{"*.example.com"}
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err != nil {
+		t.Fatalf("allowedHosts should be enough: %v", err)
+	}
+}
+
+func Test_Provision_DryRunNeverCreates(t *testing.T) {
+	api := newUmamiAPIStandIn(t)
+	api.websites = []umamiWebsite{{ID: "uuid-blog", Domain: "blog.example.com"}}
+	cfg := provisionConfig(api)
+	cfg.DryRun = true
+	cfg.DebugHeader = "X-Umami-Injector"
+
+	rr := serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://new.example.com/", nil), helloPage, nil)
+	if got := rr.Header().Get("X-Umami-Injector"); got != "skip; reason=no-website-id; dry-run" {
+		t.Fatalf("expected an unknown host to report no-website-id, got %q", got)
+	}
+	rr = serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://blog.example.com/", nil), helloPage, nil)
+	if got := rr.Header().Get("X-Umami-Injector"); got != "inject; dry-run" {
+		t.Fatalf("expected existing websites to be found, got %q", got)
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if api.creates != 0 {
+		t.Fatalf("a dry run must not create websites, got %d", api.creates)
+	}
+}
+
+func Test_Provision_OnlyForPageViews(t *testing.T) {
+	api := newUmamiAPIStandIn(t)
+	cfg := provisionConfig(api)
+
+	req := httptest.NewRequest(http.MethodGet, "https://shop.example.com/favicon.ico", nil)
+	req.Header.Set("Sec-Fetch-Dest", "image")
+	_ = serveHTML(t, cfg, req, helloPage, nil)
+
+	cfg.SamplePercent = 0
+	_ = serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://shop.example.com/", nil), helloPage, nil)
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if api.logins != 0 || api.searches != 0 {
+		t.Fatalf("bypassed requests must not reach the API, got %d logins and %d searches", api.logins, api.searches)
+	}
+}
+
+func Test_Provision_EvictsExpiredHosts(t *testing.T) {
+	api := newUmamiAPIStandIn(t)
+
+	now := time.Unix(0, 0)
+	p := &provisioner{
+		apiURL:   api.URL,
+		username: "admin",
+		password: "umami",
+		ttl:      time.Hour,
+		client:   http.DefaultClient,
+		now:      func() time.Time { return now },
+		sites:    map[string]*provisionedSite{},
+	}
+
+	ctx := context.Background()
+	_ = p.websiteID(ctx, "a.example.com")
+	_ = p.websiteID(ctx, "b.example.com")
+	now = now.Add(2 * time.Hour)
+	_ = p.websiteID(ctx, "c.example.com")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.sites) != 1 || p.sites["c.example.com"] == nil {
+		t.Fatalf("expected expired hosts to be evicted, got %d entries", len(p.sites))
+	}
+}
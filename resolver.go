@@ -0,0 +1,295 @@
+package traefikumamitaginjector
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// WebsiteIDResolver configures one step of the website ID lookup. Resolvers are tried in order
+// and the first non-empty result wins.
+type WebsiteIDResolver struct {
+	// Type is one of config, default, header, cookie, query, host, path, map, responseHeader or umami.
+	Type string `json:"type,omitempty"`
+	// Name is the request header, response header, cookie or query parameter to read.
+	Name string `json:"name,omitempty"`
+	// Pattern is the regular expression for host and path; its first capture group is the result.
+	Pattern string `json:"pattern,omitempty"`
+	// Map translates the result (e.g. a tenant slug) to a website ID; for type map it is keyed by host.
+	Map map[string]string `json:"map,omitempty"`
+}
+
+// Resolver types.
+const (
+	resolveConfig  = "config"  // Config.WebsiteID
+	resolveDefault = "default" // Config.DefaultWebsiteID
+	resolveHeader  = "header"
+	resolveCookie  = "cookie"
+	resolveQuery   = "query"
+	resolveHost    = "host"
+	resolvePath    = "path"
+	resolveMap     = "map"
+	// resolveResponseHeader reads upstream response header name; matched case-insensitively
+	// like every type, so the documented spelling is responseHeader.
+	resolveResponseHeader = "responseheader"
+	// resolveUmami looks the host up through the Umami API, creating the website if needed.
+	resolveUmami = "umami"
+)
+
+// websiteIDResolver is a validated WebsiteIDResolver.
+type websiteIDResolver struct {
+	kind   string
+	name   string
+	value  string // config and default
+	re     *regexp.Regexp
+	lookup map[string]string
+	api    *provisioner
+}
+
+// defaultWebsiteIDResolvers is the chain used when none is configured: the configured ID
+// (per-router labels), then the request header, then the default.
+func defaultWebsiteIDResolvers(cfg *Config) []WebsiteIDResolver {
+	return []WebsiteIDResolver{
+		{Type: resolveConfig},
+		{Type: resolveHeader, Name: cfg.WebsiteIDHeader},
+		{Type: resolveDefault},
+	}
+}
+
+func newWebsiteIDResolvers(cfg *Config, hostURL string, client *http.Client) ([]websiteIDResolver, error) {
+	specs := cfg.WebsiteIDResolvers
+	if len(specs) == 0 {
+		specs = defaultWebsiteIDResolvers(cfg)
+	}
+
+	var api *provisioner
+	resolvers := make([]websiteIDResolver, 0, len(specs))
+	for i, spec := range specs {
+		r := websiteIDResolver{
+			kind: strings.ToLower(strings.TrimSpace(spec.Type)),
+			name: strings.TrimSpace(spec.Name),
+		}
+		if len(spec.Map) > 0 {
+			r.lookup = make(map[string]string, len(spec.Map))
+			for k, v := range spec.Map {
+				r.lookup[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+			}
+		}
+
+		switch r.kind {
+		case resolveConfig:
+			r.value = strings.TrimSpace(cfg.WebsiteID)
+		case resolveDefault:
+			r.value = strings.TrimSpace(cfg.DefaultWebsiteID)
+		case resolveHeader, resolveCookie, resolveQuery, resolveResponseHeader:
+			if r.name == "" {
+				// An unnamed header resolver is how an empty websiteIdHeader disables the fallback.
+				if r.kind == resolveHeader && len(cfg.WebsiteIDResolvers) == 0 {
+					continue
+				}
+				return nil, fmt.Errorf("websiteIdResolvers[%d]: %s resolver requires name", i, r.kind)
+			}
+		case resolveHost, resolvePath:
+			re, err := regexp.Compile(spec.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("websiteIdResolvers[%d]: invalid pattern: %w", i, err)
+			}
+			if re.NumSubexp() < 1 {
+				return nil, fmt.Errorf("websiteIdResolvers[%d]: pattern %q has no capture group", i, spec.Pattern)
+			}
+			r.re = re
+		case resolveMap:
+			if r.lookup == nil {
+				return nil, fmt.Errorf("websiteIdResolvers[%d]: map resolver requires map", i)
+			}
+		case resolveUmami:
+			if api == nil {
+				var err error
+				if api, err = newProvisioner(cfg, hostURL, client); err != nil {
+					return nil, fmt.Errorf("websiteIdResolvers[%d]: %w", i, err)
+				}
+			}
+			r.api = api
+		default:
+			return nil, fmt.Errorf("websiteIdResolvers[%d]: unknown type %q", i, spec.Type)
+		}
+
+		resolvers = append(resolvers, r)
+	}
+	return resolvers, nil
+}
+
+// resolve returns the website ID this resolver finds for req, or "". host is the canonical host.
+func (r *websiteIDResolver) resolve(req *http.Request, host string) string {
+	var v string
+	switch r.kind {
+	case resolveConfig, resolveDefault:
+		v = r.value
+	case resolveHeader:
+		v = req.Header.Get(r.name)
+	case resolveCookie:
+		if c, err := req.Cookie(r.name); err == nil {
+			v = c.Value
+		}
+	case resolveQuery:
+		v = req.URL.Query().Get(r.name)
+	case resolveHost:
+		v = r.capture(host)
+	case resolvePath:
+		v = r.capture(req.URL.Path)
+	case resolveMap:
+		v = host
+	case resolveUmami:
+		v = r.api.websiteID(req.Context(), host)
+	}
+
+	return r.translate(v)
+}
+
+// resolveResponse returns the website ID a responseHeader resolver finds in the upstream headers, or "".
+func (r *websiteIDResolver) resolveResponse(h http.Header) string {
+	return r.translate(h.Get(r.name))
+}
+
+// translate trims a resolved value and applies the resolver's map, if any.
+func (r *websiteIDResolver) translate(v string) string {
+	v = strings.TrimSpace(v)
+	if v == "" || r.lookup == nil {
+		return v
+	}
+	return r.lookup[strings.ToLower(v)]
+}
+
+func (r *websiteIDResolver) capture(s string) string {
+	if m := r.re.FindStringSubmatch(s); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// responseHeaderNames lists the response headers read by responseHeader resolvers.
+func responseHeaderNames(resolvers []websiteIDResolver) []string {
+	var names []string
+	for _, r := range resolvers {
+		if r.kind == resolveResponseHeader {
+			names = append(names, r.name)
+		}
+	}
+	return names
+}
+
+// resolveWebsiteID runs the resolvers in order and returns the first website ID found. Once a
+// responseHeader resolver is reached the decision moves to the response: those resolvers are
+// returned, and id is only the fallback from the resolvers after them.
+func (m *Middleware) resolveWebsiteID(req *http.Request, host string) (id string, fromResponse []*websiteIDResolver) {
+	for i := range m.resolvers {
+		r := &m.resolvers[i]
+		if r.kind == resolveResponseHeader {
+			fromResponse = append(fromResponse, r)
+			continue
+		}
+		if id = r.resolve(req, host); id != "" {
+			return id, fromResponse
+		}
+	}
+	return "", fromResponse
+}
+
+// pageWebsiteID returns the website ID for a page view: the frame website ID for iframe
+// documents with frameHandling "separate", otherwise the environment's ID or the resolvers'
+// result. A matching environment's IDs always win, so they stay with its Umami instance.
+func (m *Middleware) pageWebsiteID(req *http.Request, host string, env *environment, view pageView) (id string, fromResponse []*websiteIDResolver) {
+	frame := view == pageViewFrame && m.frameHandling == frameSeparate
+	switch {
+	case env == nil && frame:
+		return m.frameWebsiteID, nil
+	case env != nil && frame:
+		return env.frameWebsiteID, nil
+	case env != nil && env.websiteID != "":
+		return env.websiteID, nil
+	}
+	return m.resolveWebsiteID(req, host)
+}
+
+// bypassWriter adjusts the headers of responses the middleware otherwise leaves alone: website
+// ID and attribute response headers are removed so they never reach the client, and private
+// makes Cache-Control private.
+type bypassWriter struct {
+	http.ResponseWriter
+	strip       []string
+	private     bool
+	wroteHeader bool
+}
+
+func (b *bypassWriter) WriteHeader(statusCode int) {
+	if !b.wroteHeader {
+		h := b.ResponseWriter.Header()
+		for _, name := range b.strip {
+			h.Del(name)
+		}
+		b.wroteHeader = statusCode >= 200 || statusCode == http.StatusSwitchingProtocols
+		if b.private && b.wroteHeader {
+			h.Set("Cache-Control", privateCacheControl(h.Get("Cache-Control")))
+		}
+	}
+	b.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (b *bypassWriter) Write(p []byte) (int, error) {
+	if !b.wroteHeader {
+		b.WriteHeader(http.StatusOK)
+	}
+	return b.ResponseWriter.Write(p)
+}
+
+func (b *bypassWriter) Flush() {
+	if !b.wroteHeader {
+		b.WriteHeader(http.StatusOK)
+	}
+	if f, ok := b.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (b *bypassWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := b.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return h.Hijack()
+}
+
+func (b *bypassWriter) Unwrap() http.ResponseWriter {
+	return b.ResponseWriter
+}
+
+// ReadFrom implements io.ReaderFrom, keeping sendfile available to bypassed responses.
+func (b *bypassWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !b.wroteHeader {
+		b.WriteHeader(http.StatusOK)
+	}
+	if rf, ok := b.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(b.ResponseWriter, r)
+}
+
+// Push implements http.Pusher when the original writer supports HTTP/2 server push.
+func (b *bypassWriter) Push(target string, opts *http.PushOptions) error {
+	return pushVia(b.ResponseWriter, target, opts)
+}
+
+// SetReadDeadline forwards to the first writer in the Unwrap chain that supports it.
+func (b *bypassWriter) SetReadDeadline(deadline time.Time) error {
+	return setReadDeadlineVia(b.ResponseWriter, deadline)
+}
+
+// SetWriteDeadline forwards to the first writer in the Unwrap chain that supports it.
+func (b *bypassWriter) SetWriteDeadline(deadline time.Time) error {
+	return setWriteDeadlineVia(b.ResponseWriter, deadline)
+}
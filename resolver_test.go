@@ -0,0 +1,218 @@
+package traefikumamitaginjector
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// websiteIDIn returns the data-website-id injected into body, or "".
+func websiteIDIn(body string) string {
+	const marker = `data-website-id="`
+	i := strings.Index(body, marker)
+	if i < 0 {
+		return ""
+	}
+	rest := body[i+len(marker):]
+	return rest[:strings.IndexByte(rest, '"')]
+}
+
+func Test_Resolvers_InOrder(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DefaultWebsiteID = "uuid-default"
+	cfg.WebsiteIDResolvers = []WebsiteIDResolver{
+		{Type: resolveQuery, Name: "umami"},
+		{Type: resolveCookie, Name: "tenant_site"},
+		{Type: resolvePath, Pattern: `^/t/([a-z]+)/`, Map: map[string]string{"acme": "uuid-acme-path"}},
+		{Type: resolveHost, Pattern: `^([a-z0-9-]+)\.saas\.example$`},
+		{Type: resolveMap, Map: map[string]string{"www.example.com": "uuid-www"}},
+		{Type: resolveDefault},
+	}
+
+	cases := []struct {
+		name   string
+		target string
+		cookie string
+		want   string
+	}{
+		{"query", "https://acme.saas.example/t/acme/?umami=uuid-query", "uuid-cookie", "uuid-query"},
+		{"cookie", "https://acme.saas.example/t/acme/", "uuid-cookie", "uuid-cookie"},
+		{"path capture mapped", "https://acme.saas.example/t/acme/", "", "uuid-acme-path"},
+		{"path capture unmapped falls through", "https://acme.saas.example/t/other/", "", "acme"},
+		{"host capture", "https://Globex.saas.example:8443/", "", "globex"},
+		{"static map", "https://www.example.com/", "", "uuid-www"},
+		{"default", "https://other.example/", "", "uuid-default"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			if tc.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "tenant_site", Value: tc.cookie})
+			}
+			if got := websiteIDIn(serveHTML(t, cfg, req, helloPage, nil).Body.String()); got != tc.want {
+				t.Fatalf("expected website ID %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func Test_Resolvers_UseCanonicalHost(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.AllowedHosts = []string{"*.example.com"}
+	cfg.WebsiteIDResolvers = []WebsiteIDResolver{
+		{Type: resolveMap, Map: map[string]string{"www.example.com": "uuid-www"}},
+		{Type: resolveHost, Pattern: `^([a-z]+)\.example\.com$`},
+	}
+
+	for forwarded, want := range map[string]string{"WWW.example.com:443": "uuid-www", "shop.example.com": "shop"} {
+		req := httptest.NewRequest(http.MethodGet, "http://backend.internal:8080/", nil)
+		req.Header.Set("X-Forwarded-Host", forwarded)
+		if got := websiteIDIn(serveHTML(t, cfg, req, helloPage, nil).Body.String()); got != want {
+			t.Fatalf("X-Forwarded-Host %q: expected website ID %q, got %q", forwarded, want, got)
+		}
+	}
+}
+
+func Test_Resolvers_NoMatch_Passthrough(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.WebsiteIDResolvers = []WebsiteIDResolver{{Type: resolveHeader, Name: "X-Site"}}
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	if got := websiteIDIn(serveHTML(t, cfg, req, helloPage, nil).Body.String()); got != "" {
+		t.Fatalf("expected no injection without a website ID, got %q", got)
+	}
+}
+
+func Test_Resolvers_InvalidConfig(t *testing.T) {
+	for _, r := range []WebsiteIDResolver{
+		{Type: "ldap"},
+		{Type: resolveCookie},
+		{Type: resolveHost, Pattern: `(`},
+		{Type: resolvePath, Pattern: `^/t/`},
+		{Type: resolveMap},
+	} {
+		cfg := CreateConfig()
+		cfg.WebsiteIDResolvers = []WebsiteIDResolver{r}
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+			t.Fatalf("expected resolver %+v to be rejected", r)
+		}
+	}
+}
+
+func Test_Resolvers_ResponseHeader(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.WebsiteIDResolvers = []WebsiteIDResolver{{Type: "responseHeader", Name: "X-Umami-Site"}}
+
+	rr := serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://example.com/", nil), helloPage,
+		map[string]string{"ETag": `"v1"`, "X-Umami-Site": "uuid-upstream"})
+
+	mustContain(t, rr.Body.String(), scriptSnippet(cfg.ScriptSrc, "uuid-upstream"), "upstream header should pick the site")
+	if rr.Header().Get("X-Umami-Site") != "" {
+		t.Fatalf("website ID header must not reach the client")
+	}
+
+	rr = serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://example.com/", nil), helloPage,
+		map[string]string{"ETag": `"v1"`, "X-Umami-Site": ""})
+	mustNotContain(t, rr.Body.String(), cfg.ScriptSrc, "no header and no fallback should passthrough")
+	if rr.Header().Get("ETag") != `"v1"` {
+		t.Fatalf("passthrough should keep the upstream ETag, got %q", rr.Header().Get("ETag"))
+	}
+
+	rr = serveHTML(t, cfg, httptest.NewRequest(http.MethodHead, "https://example.com/", nil), helloPage,
+		map[string]string{"ETag": `"v1"`, "X-Umami-Site": "uuid-upstream"})
+	if rr.Header().Get("X-Umami-Site") != "" || rr.Header().Get("ETag") == `"v1"` {
+		t.Fatalf("HEAD should get the injected GET's headers, got %v", rr.Header())
+	}
+}
+
+func Test_Resolvers_ResponseHeader_FallbackAndOrder(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid-config"
+	cfg.DefaultWebsiteID = "uuid-default"
+	cfg.WebsiteIDResolvers = []WebsiteIDResolver{
+		{Type: resolveQuery, Name: "site"},
+		{Type: "responseHeader", Name: "X-Umami-Site", Map: map[string]string{"blog": "uuid-blog"}},
+		{Type: resolveDefault},
+	}
+
+	rr := serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://example.com/", nil), helloPage,
+		map[string]string{"ETag": `"v1"`, "X-Umami-Site": "blog"})
+	mustContain(t, rr.Body.String(), scriptSnippet(cfg.ScriptSrc, "uuid-blog"), "mapped upstream value should win over later resolvers")
+
+	rr = serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://example.com/", nil), helloPage,
+		map[string]string{"ETag": `"v1"`, "X-Umami-Site": ""})
+	mustContain(t, rr.Body.String(), scriptSnippet(cfg.ScriptSrc, "uuid-default"), "later resolvers are the fallback")
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		rw.Header().Set("X-Umami-Site", "blog")
+		_, _ = rw.Write([]byte("<html><head></head></html>"))
+	})
+	rr = httptest.NewRecorder()
+	newTestMiddleware(t, next, cfg).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/?site=uuid-query", nil))
+	mustContain(t, rr.Body.String(), scriptSnippet(cfg.ScriptSrc, "uuid-query"), "earlier request resolvers take precedence")
+	if rr.Header().Get("X-Umami-Site") != "" {
+		t.Fatalf("website ID header must be stripped even when unused")
+	}
+}
+
+func Test_Resolvers_ResponseHeader_ETagFollowsSite(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.WebsiteIDResolvers = []WebsiteIDResolver{{Type: "responseHeader", Name: "X-Umami-Site"}}
+
+	a := serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://example.com/", nil), helloPage,
+		map[string]string{"ETag": `"v1"`, "X-Umami-Site": "uuid-a"}).Header().Get("ETag")
+	b := serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://example.com/", nil), helloPage,
+		map[string]string{"ETag": `"v1"`, "X-Umami-Site": "uuid-b"}).Header().Get("ETag")
+	if a == b {
+		t.Fatalf("expected derived entity tags to depend on the upstream website ID, both %q", a)
+	}
+}
+
+func Test_Resolvers_ResponseHeader_StrippedOnBypass(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.WebsiteIDResolvers = []WebsiteIDResolver{{Type: "responseHeader", Name: "X-Umami-Site"}}
+
+	rr := serveHTML(t, cfg, httptest.NewRequest(http.MethodPost, "https://example.com/", nil), helloPage,
+		map[string]string{"ETag": `"v1"`, "X-Umami-Site": "uuid-upstream"})
+
+	if rr.Header().Get("X-Umami-Site") != "" {
+		t.Fatalf("website ID header must be stripped from bypassed responses too")
+	}
+	if rr.Body.String() != "<html><head></head><body>Hello</body></html>" {
+		t.Fatalf("bypassed body should be untouched, got %q", rr.Body.String())
+	}
+}
+
+func Test_Resolvers_ResponseHeader_BypassKeepsInterfaces(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		if _, ok := rw.(readDeadliner); !ok {
+			t.Fatalf("expected SetReadDeadline on bypassed responses")
+		}
+		if _, ok := rw.(writeDeadliner); !ok {
+			t.Fatalf("expected SetWriteDeadline on bypassed responses")
+		}
+		if err := rw.(http.Pusher).Push("/style.css", nil); err != nil {
+			t.Fatalf("Push: %v", err)
+		}
+		rw.Header().Set("X-Umami-Site", "uuid-upstream")
+		_, _ = rw.(io.ReaderFrom).ReadFrom(strings.NewReader("ok"))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteIDResolvers = []WebsiteIDResolver{{Type: "responseHeader", Name: "X-Umami-Site"}}
+
+	cw := &capabilityWriter{ResponseRecorder: httptest.NewRecorder()}
+	newTestMiddleware(t, next, cfg).ServeHTTP(cw, httptest.NewRequest(http.MethodPost, "https://example.com/", nil))
+
+	if cw.readFromCalls != 1 || cw.Body.String() != "ok" || len(cw.pushed) != 1 {
+		t.Fatalf("expected ReadFrom and Push forwarded, got %d calls, body %q, pushed %v", cw.readFromCalls, cw.Body.String(), cw.pushed)
+	}
+	if cw.Header().Get("X-Umami-Site") != "" {
+		t.Fatalf("website ID header must be stripped before ReadFrom writes")
+	}
+}
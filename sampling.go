@@ -0,0 +1,100 @@
+package traefikumamitaginjector
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// SampleKey values.
+const (
+	sampleByClient = "client" // client IP + User-Agent
+	sampleByCookie = "cookie" // random visitor ID in a cookie set by the middleware
+)
+
+// sampleCookieMaxAge keeps a visitor in the same bucket for a year.
+const sampleCookieMaxAge = 365 * 24 * 60 * 60
+
+// parseSampling validates the sampling settings of cfg and returns the sample key.
+func parseSampling(cfg *Config) (string, error) {
+	if cfg.SamplePercent < 0 || cfg.SamplePercent > 100 {
+		return "", fmt.Errorf("samplePercent %v out of range 0-100", cfg.SamplePercent)
+	}
+	// Umami takes data-tag as a single value: a tenant tag and the sample rate can't share it.
+	if cfg.SamplePercent < 100 && strings.TrimSpace(cfg.TagHeader) != "" {
+		return "", errors.New("tagHeader can't be combined with samplePercent below 100")
+	}
+
+	sampleKey := strings.ToLower(strings.TrimSpace(cfg.SampleKey))
+	switch sampleKey {
+	case "":
+		return sampleByClient, nil
+	case sampleByClient:
+		return sampleKey, nil
+	case sampleByCookie:
+		if strings.TrimSpace(cfg.SampleCookie) == "" {
+			return "", fmt.Errorf("sampleKey %q requires sampleCookie", sampleByCookie)
+		}
+		return sampleKey, nil
+	default:
+		return "", fmt.Errorf("unknown sampleKey %q (want %q or %q)", cfg.SampleKey, sampleByClient, sampleByCookie)
+	}
+}
+
+// sampled reports whether the visitor behind req is in the tracked sample. A cookie to set on
+// the response is returned when the visitor has none yet.
+func (m *Middleware) sampled(req *http.Request) (bool, *http.Cookie) {
+	if m.samplePercent >= 100 {
+		return true, nil
+	}
+
+	var key string
+	var set *http.Cookie
+	switch m.sampleKey {
+	case sampleByCookie:
+		if c, err := req.Cookie(m.sampleCookie); err == nil && c.Value != "" {
+			key = c.Value
+		} else {
+			key = newVisitorID()
+			set = &http.Cookie{
+				Name:     m.sampleCookie,
+				Value:    key,
+				Path:     "/",
+				MaxAge:   sampleCookieMaxAge,
+				HttpOnly: true,
+				Secure:   isHTTPS(req),
+				SameSite: http.SameSiteLaxMode,
+			}
+		}
+	default:
+		key = clientIP(req) + "\x00" + req.UserAgent()
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	// Buckets of 0.01% so fractional rates like 0.5 work.
+	return float64(h.Sum32()%10000) < m.samplePercent*100, set
+}
+
+// sampleTag is the data-tag recording the sample rate, e.g. "sample-25".
+func (m *Middleware) sampleTag() string {
+	if m.samplePercent >= 100 {
+		return ""
+	}
+	return "sample-" + strconv.FormatFloat(m.samplePercent, 'f', -1, 64)
+}
+
+func newVisitorID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isHTTPS(req *http.Request) bool {
+	return req.TLS != nil || strings.EqualFold(req.Header.Get("X-Forwarded-Proto"), "https")
+}
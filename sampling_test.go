@@ -0,0 +1,159 @@
+package traefikumamitaginjector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func samplingHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = rw.Write([]byte("<html><head></head><body>Hello</body></html>"))
+	})
+}
+
+func Test_Sampling_DeterministicPerClient(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.SamplePercent = 25
+	mw := newTestMiddleware(t, samplingHandler(), cfg)
+
+	tracked := 0
+	for i := 0; i < 400; i++ {
+		serve := func() bool {
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			req.Header.Set("X-Forwarded-For", fmt.Sprintf("198.51.100.%d", i%256))
+			req.Header.Set("User-Agent", fmt.Sprintf("agent-%d", i))
+			rr := httptest.NewRecorder()
+			mw.ServeHTTP(rr, req)
+			return strings.Contains(rr.Body.String(), cfg.ScriptSrc)
+		}
+
+		first := serve()
+		if serve() != first {
+			t.Fatalf("visitor %d flipped between tracked and untracked", i)
+		}
+		if first {
+			tracked++
+		}
+	}
+
+	if tracked < 60 || tracked > 140 {
+		t.Fatalf("expected about 25%% of 400 visitors to be tracked, got %d", tracked)
+	}
+}
+
+func Test_Sampling_ReportsRateInDataTag(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.SamplePercent = 100
+
+	rr := serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://example.com/", nil), helloPage, nil)
+	mustNotContain(t, rr.Body.String(), "data-tag", "no sample tag at 100%")
+
+	cfg.SamplePercent = 99.99
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		req.Header.Set("User-Agent", fmt.Sprintf("agent-%d", i))
+		rr = serveHTML(t, cfg, req, helloPage, nil)
+		if strings.Contains(rr.Body.String(), cfg.ScriptSrc) {
+			mustContain(t, rr.Body.String(), `data-tag="sample-99.99"`, "sample rate should be reported")
+			return
+		}
+	}
+	t.Fatalf("expected at least one tracked visitor")
+}
+
+func Test_Sampling_StickyCookie(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.SamplePercent = 50
+	cfg.SampleKey = sampleByCookie
+	mw := newTestMiddleware(t, samplingHandler(), cfg)
+
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "_umami_sample" || cookies[0].Value == "" || !cookies[0].HttpOnly {
+		t.Fatalf("expected a sampling cookie on the first visit, got %v", rr.Header()["Set-Cookie"])
+	}
+	tracked := strings.Contains(rr.Body.String(), cfg.ScriptSrc)
+
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		req.AddCookie(cookies[0])
+		req.Header.Set("User-Agent", fmt.Sprintf("agent-%d", i))
+		rr = httptest.NewRecorder()
+		mw.ServeHTTP(rr, req)
+
+		if got := strings.Contains(rr.Body.String(), cfg.ScriptSrc); got != tracked {
+			t.Fatalf("cookie should keep the visitor in the same bucket")
+		}
+		if rr.Header().Get("Set-Cookie") != "" {
+			t.Fatalf("cookie must not be reissued")
+		}
+	}
+}
+
+func Test_Sampling_CookieSetOnBothPaths(t *testing.T) {
+	for _, percent := range []float64{0, 99.99} {
+		cfg := CreateConfig()
+		cfg.WebsiteID = "uuid"
+		cfg.SamplePercent = percent
+		cfg.SampleKey = sampleByCookie
+
+		rr := httptest.NewRecorder()
+		newTestMiddleware(t, samplingHandler(), cfg).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+		if !strings.HasPrefix(rr.Header().Get("Set-Cookie"), "_umami_sample=") {
+			t.Fatalf("samplePercent=%v: expected the sampling cookie, got %v", percent, rr.Header())
+		}
+	}
+}
+
+func Test_Sampling_KeepsPagesOutOfSharedCaches(t *testing.T) {
+	for _, key := range []string{sampleByClient, sampleByCookie} {
+		for _, percent := range []float64{0, 99.99} {
+			cfg := CreateConfig()
+			cfg.WebsiteID = "uuid"
+			cfg.SamplePercent = percent
+			cfg.SampleKey = key
+
+			rr := serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://example.com/", nil), helloPage,
+				map[string]string{"Cache-Control": "public, max-age=60"})
+
+			if got := rr.Header().Get("Cache-Control"); got != "max-age=60, private" {
+				t.Fatalf("%s at %v%%: expected a private Cache-Control, got %q", key, percent, got)
+			}
+		}
+	}
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	rr := serveHTML(t, cfg, httptest.NewRequest(http.MethodGet, "https://example.com/", nil), helloPage,
+		map[string]string{"Cache-Control": "public, max-age=60"})
+	if got := rr.Header().Get("Cache-Control"); got != "public, max-age=60" {
+		t.Fatalf("Cache-Control should be untouched without sampling, got %q", got)
+	}
+}
+
+func Test_Sampling_InvalidConfig(t *testing.T) {
+	for _, mutate := range []func(*Config){
+		func(c *Config) { c.SamplePercent = 101 },
+		func(c *Config) { c.SamplePercent = -1 },
+		func(c *Config) { c.SampleKey = "ip" },
+		func(c *Config) { c.SampleKey = sampleByCookie; c.SampleCookie = "" },
+		func(c *Config) { c.SamplePercent = 50; c.TagHeader = "X-Analytics-Tag" },
+	} {
+		cfg := CreateConfig()
+		mutate(cfg)
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+			t.Fatalf("expected a configuration error for %+v", cfg)
+		}
+	}
+}
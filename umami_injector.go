@@ -6,9 +6,18 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type htmlCandidate int
@@ -30,6 +39,55 @@ type Config struct {
 	AlsoMatchBodyClose  bool   `json:"alsoMatchBodyClose,omitempty"`
 	StripAcceptEncoding bool   `json:"stripAcceptEncoding,omitempty"`
 	InjectOnNon2xx      bool   `json:"injectOnNon2xx,omitempty"`
+	NoscriptPixel       bool   `json:"noscriptPixel,omitempty"`      // <noscript> tracking pixel after <body>
+	PixelPath           string `json:"pixelPath,omitempty"`          // first-party endpoint serving the pixel
+	HostURL             string `json:"hostUrl,omitempty"`            // Umami base URL, defaults to the origin of scriptSrc
+	RangeHandling       string `json:"rangeHandling,omitempty"`      // "strip" or "passthrough"
+	EarlyHintsPreload   bool   `json:"earlyHintsPreload,omitempty"`  // add a preload Link for scriptSrc to upstream 103s
+	SendEarlyHints      bool   `json:"sendEarlyHints,omitempty"`     // send our own 103 on HTML navigations
+	MaxDecisionDelay    string `json:"maxDecisionDelay,omitempty"`   // e.g. "200ms"; bounds time to first byte, empty = off
+	FlushPartialPrefix  bool   `json:"flushPartialPrefix,omitempty"` // on upstream Flush without an anchor, flush a safe prefix and keep searching
+	AMPAnalytics        bool   `json:"ampAnalytics,omitempty"`       // track AMP pages with <amp-analytics> via the pixel endpoint
+
+	WebsiteIDResolvers []WebsiteIDResolver `json:"websiteIdResolvers,omitempty"` // ordered; empty = websiteId, websiteIdHeader, defaultWebsiteId
+
+	UmamiUsername        string `json:"umamiUsername,omitempty"`        // API login for the umami resolver
+	UmamiPassword        string `json:"umamiPassword,omitempty"`        // API password for the umami resolver
+	ProvisionTTL         string `json:"provisionTtl,omitempty"`         // how long host -> website mappings are cached, e.g. "1h"
+	ProvisionHostPattern string `json:"provisionHostPattern,omitempty"` // regexp hosts must match to be looked up or created
+
+	SkipPartialRequests   bool     `json:"skipPartialRequests,omitempty"`   // pass through fragment requests from htmx, Turbo, pjax, Unpoly
+	PartialRequestHeaders []string `json:"partialRequestHeaders,omitempty"` // request headers marking a fragment request
+
+	RespectFetchMetadata bool   `json:"respectFetchMetadata,omitempty"` // use Sec-Fetch-* / Sec-Purpose to find real page views
+	FrameHandling        string `json:"frameHandling,omitempty"`        // "skip", "inject" or "separate" for iframe documents
+	FrameWebsiteID       string `json:"frameWebsiteId,omitempty"`       // website ID for iframe documents with frameHandling "separate"
+	PrefetchHandling     string `json:"prefetchHandling,omitempty"`     // "skip" or "inject" for prefetch/prerender requests
+
+	IdentifyUserHeader string            `json:"identifyUserHeader,omitempty"` // e.g. X-Forwarded-User; enables umami.identify()
+	IdentifySecret     string            `json:"identifySecret,omitempty"`     // HMAC key for the user ID
+	IdentifyProperties map[string]string `json:"identifyProperties,omitempty"` // session property -> request header
+
+	TagHeader             string            `json:"tagHeader,omitempty"`             // response header whose value becomes data-tag
+	EventHeaders          map[string]string `json:"eventHeaders,omitempty"`          // event property -> response header, sent with umami.track()
+	EventName             string            `json:"eventName,omitempty"`             // name of that event
+	StripAttributeHeaders bool              `json:"stripAttributeHeaders,omitempty"` // remove tagHeader/eventHeaders from responses
+
+	SamplePercent float64 `json:"samplePercent,omitempty"` // share of visitors to track, 0-100
+	SampleKey     string  `json:"sampleKey,omitempty"`     // "client" (IP + User-Agent) or "cookie"
+	SampleCookie  string  `json:"sampleCookie,omitempty"`  // cookie name for sampleKey "cookie"
+
+	Environments []Environment `json:"environments,omitempty"` // per-environment scriptSrc, hostUrl and websiteId, first match wins
+
+	ScriptVersion      string `json:"scriptVersion,omitempty"`      // pins scriptSrc to this version via a query parameter
+	ScriptHashRefresh  string `json:"scriptHashRefresh,omitempty"`  // e.g. "1h"; pins scriptSrc to a hash of its content, refreshed this often
+	ScriptVersionParam string `json:"scriptVersionParam,omitempty"` // query parameter carrying the version
+
+	DataDomains  string   `json:"dataDomains,omitempty"`  // "host" or "allowlist" fills data-domains; empty = off
+	AllowedHosts []string `json:"allowedHosts,omitempty"` // hosts ("*.example.com" for subdomains) that get the script; empty = all
+
+	DryRun      bool   `json:"dryRun,omitempty"`      // decide as usual but never modify responses
+	DebugHeader string `json:"debugHeader,omitempty"` // response header reporting the outcome, e.g. X-Umami-Injector
 }
 
 // CreateConfig creates the default plugin configuration.
@@ -44,86 +102,468 @@ func CreateConfig() *Config {
 		AlsoMatchBodyClose:  true,
 		StripAcceptEncoding: true,
 		InjectOnNon2xx:      false,
+		NoscriptPixel:       false,
+		PixelPath:           "/_umami/pixel",
+		HostURL:             "",
+		RangeHandling:       rangeStrip,
+		EarlyHintsPreload:   false,
+		SendEarlyHints:      false,
+		MaxDecisionDelay:    "",
+		FlushPartialPrefix:  false,
+		AMPAnalytics:        false,
+
+		WebsiteIDResolvers: nil,
+
+		UmamiUsername:        "",
+		UmamiPassword:        "",
+		ProvisionTTL:         "1h",
+		ProvisionHostPattern: "",
+
+		SkipPartialRequests:   true,
+		PartialRequestHeaders: []string{"HX-Request", "Turbo-Frame", "X-PJAX", "X-Up-Target"},
+
+		RespectFetchMetadata: true,
+		FrameHandling:        frameSkip,
+		FrameWebsiteID:       "",
+		PrefetchHandling:     prefetchSkip,
+
+		IdentifyUserHeader: "",
+		IdentifySecret:     "",
+		IdentifyProperties: nil,
+
+		TagHeader:             "",
+		EventHeaders:          nil,
+		EventName:             "page-context",
+		StripAttributeHeaders: false,
+
+		SamplePercent: 100,
+		SampleKey:     sampleByClient,
+		SampleCookie:  "_umami_sample",
+
+		Environments: nil,
+
+		ScriptVersion:      "",
+		ScriptHashRefresh:  "",
+		ScriptVersionParam: "v",
+
+		DataDomains:  "",
+		AllowedHosts: nil,
+
+		DryRun:      false,
+		DebugHeader: "",
 	}
 }
 
+// RangeHandling values.
+const (
+	// rangeStrip removes Range from HTML navigations so they get a full, injectable 200.
+	rangeStrip = "strip"
+	// rangePassthrough forwards Range untouched; the resulting 206 responses are never rewritten.
+	rangePassthrough = "passthrough"
+)
+
+// FrameHandling values.
+const (
+	frameSkip     = "skip"
+	frameInject   = "inject"
+	frameSeparate = "separate" // inject with FrameWebsiteID
+)
+
+// PrefetchHandling values.
+const (
+	prefetchSkip   = "skip"
+	prefetchInject = "inject"
+)
+
 // Middleware is a Traefik HTTP middleware that injects an Umami tracking script into HTML responses.
 type Middleware struct {
 	next http.Handler
 
 	scriptSrc           string
-	websiteID           string
-	defaultWebsiteID    string
-	websiteIDHeader     string
+	resolvers           []websiteIDResolver
+	websiteIDHeaders    []string // response headers carrying a website ID, stripped from responses
+	bypassStrip         []string // website ID and attribute headers, stripped from bypassed responses
 	maxLookaheadBytes   int
 	injectBefore        string
 	alsoMatchBodyClose  bool
 	stripAcceptEncoding bool
 	injectOnNon2xx      bool
+	noscriptPixel       bool
+	pixelPath           string
+	hostURL             string
+	stripRange          bool
+	earlyHintsPreload   bool
+	sendEarlyHints      bool
+	maxDecisionDelay    time.Duration
+	flushPartialPrefix  bool
+	ampAnalytics        bool
+	partialHeaders      []string // nil when partial requests are not skipped
+	fetchMetadata       bool
+	frameHandling       string
+	frameWebsiteID      string
+	injectPrefetch      bool
+	identifyUserHeader  string
+	identifySecret      []byte
+	identifyProperties  map[string]string
+	attributes          *responseAttributes
+	samplePercent       float64
+	sampleKey           string
+	sampleCookie        string
+	environments        []environment
+	versions            *scriptVersions
+	domainsMode         string
+	allowedHosts        []string
+	dryRun              bool
+	debugHeader         string
+
+	client *http.Client
 }
 
 // New constructs a new Middleware instance.
 func New(_ context.Context, next http.Handler, cfg *Config, _ string) (http.Handler, error) {
+	hostURL := trackerHostURL(cfg)
+	pixelPath, err := parsePixelPath(cfg, hostURL)
+	if err != nil {
+		return nil, err
+	}
+	stripRange, err := parseRangeHandling(cfg)
+	if err != nil {
+		return nil, err
+	}
+	maxDecisionDelay, err := parseMaxDecisionDelay(cfg)
+	if err != nil {
+		return nil, err
+	}
+	frameHandling, injectPrefetch, err := parseNavigationHandling(cfg)
+	if err != nil {
+		return nil, err
+	}
+	identifyUserHeader, identifyProperties, err := parseIdentify(cfg)
+	if err != nil {
+		return nil, err
+	}
+	attributes, err := newResponseAttributes(cfg)
+	if err != nil {
+		return nil, err
+	}
+	sampleKey, err := parseSampling(cfg)
+	if err != nil {
+		return nil, err
+	}
+	environments, err := newEnvironments(cfg)
+	if err != nil {
+		return nil, err
+	}
+	allowedHosts, domainsMode, err := parseDomains(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	versions, err := newScriptVersions(cfg, client)
+	if err != nil {
+		return nil, err
+	}
+	resolvers, err := newWebsiteIDResolvers(cfg, hostURL, client)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Middleware{
 		next: next,
 
 		scriptSrc:           cfg.ScriptSrc,
-		websiteID:           strings.TrimSpace(cfg.WebsiteID),
-		defaultWebsiteID:    strings.TrimSpace(cfg.DefaultWebsiteID),
-		websiteIDHeader:     cfg.WebsiteIDHeader,
+		resolvers:           resolvers,
+		websiteIDHeaders:    responseHeaderNames(resolvers),
+		bypassStrip:         append(responseHeaderNames(resolvers), attributes.stripped()...),
 		maxLookaheadBytes:   cfg.MaxLookaheadBytes,
 		injectBefore:        cfg.InjectBefore,
 		alsoMatchBodyClose:  cfg.AlsoMatchBodyClose,
 		stripAcceptEncoding: cfg.StripAcceptEncoding,
 		injectOnNon2xx:      cfg.InjectOnNon2xx,
+		noscriptPixel:       cfg.NoscriptPixel,
+		pixelPath:           pixelPath,
+		hostURL:             hostURL,
+		stripRange:          stripRange,
+		earlyHintsPreload:   cfg.EarlyHintsPreload,
+		sendEarlyHints:      cfg.SendEarlyHints,
+		maxDecisionDelay:    maxDecisionDelay,
+		flushPartialPrefix:  cfg.FlushPartialPrefix,
+		ampAnalytics:        cfg.AMPAnalytics,
+		partialHeaders:      partialRequestHeaders(cfg),
+		fetchMetadata:       cfg.RespectFetchMetadata,
+		frameHandling:       frameHandling,
+		frameWebsiteID:      strings.TrimSpace(cfg.FrameWebsiteID),
+		injectPrefetch:      injectPrefetch,
+		identifyUserHeader:  identifyUserHeader,
+		identifySecret:      []byte(cfg.IdentifySecret),
+		identifyProperties:  identifyProperties,
+		attributes:          attributes,
+		samplePercent:       cfg.SamplePercent,
+		sampleKey:           sampleKey,
+		sampleCookie:        strings.TrimSpace(cfg.SampleCookie),
+		environments:        environments,
+		versions:            versions,
+		domainsMode:         domainsMode,
+		allowedHosts:        allowedHosts,
+		dryRun:              cfg.DryRun,
+		debugHeader:         strings.TrimSpace(cfg.DebugHeader),
+
+		client: client,
 	}, nil
 }
 
+// trackerHostURL is the Umami instance the pixel reports to and the API lives at: hostUrl, or
+// the origin of an absolute scriptSrc.
+func trackerHostURL(cfg *Config) string {
+	if hostURL := strings.TrimRight(strings.TrimSpace(cfg.HostURL), "/"); hostURL != "" {
+		return hostURL
+	}
+	return originOf(cfg.ScriptSrc)
+}
+
+// parseRangeHandling reports whether Range is stripped from HTML navigations.
+func parseRangeHandling(cfg *Config) (stripRange bool, err error) {
+	rangeHandling := strings.ToLower(strings.TrimSpace(cfg.RangeHandling))
+	if rangeHandling != "" && rangeHandling != rangeStrip && rangeHandling != rangePassthrough {
+		return false, fmt.Errorf("unknown rangeHandling %q (want %q or %q)", cfg.RangeHandling, rangeStrip, rangePassthrough)
+	}
+	return rangeHandling != rangePassthrough, nil
+}
+
+// parseMaxDecisionDelay returns the decision delay bound, 0 if unbounded.
+func parseMaxDecisionDelay(cfg *Config) (time.Duration, error) {
+	v := strings.TrimSpace(cfg.MaxDecisionDelay)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid maxDecisionDelay %q", cfg.MaxDecisionDelay)
+	}
+	return d, nil
+}
+
+// parseNavigationHandling validates frameHandling and prefetchHandling, which decide what the
+// fetch metadata of a request makes a page view.
+func parseNavigationHandling(cfg *Config) (frameHandling string, injectPrefetch bool, err error) {
+	frameHandling = strings.ToLower(strings.TrimSpace(cfg.FrameHandling))
+	switch frameHandling {
+	case "":
+		frameHandling = frameSkip
+	case frameSkip, frameInject:
+	case frameSeparate:
+		if strings.TrimSpace(cfg.FrameWebsiteID) == "" {
+			return "", false, fmt.Errorf("frameHandling %q requires frameWebsiteId", frameSeparate)
+		}
+	default:
+		return "", false, fmt.Errorf("unknown frameHandling %q (want %q, %q or %q)", cfg.FrameHandling, frameSkip, frameInject, frameSeparate)
+	}
+
+	prefetchHandling := strings.ToLower(strings.TrimSpace(cfg.PrefetchHandling))
+	if prefetchHandling != "" && prefetchHandling != prefetchSkip && prefetchHandling != prefetchInject {
+		return "", false, fmt.Errorf("unknown prefetchHandling %q (want %q or %q)", cfg.PrefetchHandling, prefetchSkip, prefetchInject)
+	}
+	return frameHandling, prefetchHandling == prefetchInject, nil
+}
+
+// partialRequestHeaders returns the request headers marking a fragment request, nil when
+// fragments are not skipped.
+func partialRequestHeaders(cfg *Config) []string {
+	if !cfg.SkipPartialRequests {
+		return nil
+	}
+	var headers []string
+	for _, h := range cfg.PartialRequestHeaders {
+		if h = strings.TrimSpace(h); h != "" {
+			headers = append(headers, h)
+		}
+	}
+	return headers
+}
+
+// originOf returns the scheme://host part of an absolute URL, or "" if raw is not absolute.
+func originOf(raw string) string {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
 func (m *Middleware) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	if req.Method != http.MethodGet {
-		m.next.ServeHTTP(rw, req)
+	if (m.noscriptPixel || m.ampAnalytics) && req.URL.Path == m.pixelPath {
+		m.servePixel(rw, req)
 		return
 	}
 
-	if isUpgradeRequest(req) {
-		m.next.ServeHTTP(rw, req)
+	host := canonicalHost(req)
+	view, reason := m.eligible(req, host)
+	if reason != "" {
+		m.bypass(rw, req, reason, false)
 		return
 	}
 
-	websiteID := strings.TrimSpace(m.websiteID)
-	if websiteID == "" {
-		websiteID = strings.TrimSpace(req.Header.Get(m.websiteIDHeader))
+	inSample, cookie := m.sampled(req)
+	if m.dryRun {
+		cookie = nil
 	}
-	if websiteID == "" {
-		websiteID = strings.TrimSpace(m.defaultWebsiteID)
+	if !inSample {
+		if cookie != nil {
+			http.SetCookie(rw, cookie)
+		}
+		// Sampled-in visitors get another page at the same URL: keep this one out of shared caches.
+		m.bypass(rw, req, "not-sampled", m.samplePercent < 100 && !m.dryRun)
+		return
 	}
-	if websiteID == "" {
-		m.next.ServeHTTP(rw, req)
+
+	// Resolution may wait on the Umami API: only page views that get the script pay for it.
+	env := m.environment(req, host)
+	websiteID, fromResponse := m.pageWebsiteID(req, host, env, view)
+	if websiteID == "" && fromResponse == nil {
+		m.bypass(rw, req, "no-website-id", false)
 		return
 	}
 
-	reqToForward := req
-	if m.stripAcceptEncoding {
-		cloned := req.Clone(req.Context())
-		cloned.Header = req.Header.Clone()
-		cloned.Header.Del("Accept-Encoding")
-		reqToForward = cloned
+	t := &tracker{
+		scriptSrc: m.scriptSrc,
+		websiteID: websiteID,
+		sampleTag: m.sampleTag(),
+		domains:   m.dataDomains(host),
+	}
+	if env != nil {
+		t.scriptSrc, t.hostURL = env.scriptSrc, env.dataHostURL
+	}
+	t.version, t.versionParam = m.versions.version(t.scriptSrc), m.versions.param
+	if m.noscriptPixel {
+		t.pixelPath, t.pageURI = m.pixelPath, req.URL.RequestURI()
+	}
+	if m.ampAnalytics {
+		t.ampPixelPath = m.pixelPath
+	}
+	if id, props, ok := m.identity(req); ok {
+		if script, err := identifyScript(id, props); err == nil {
+			t.identify = script
+		}
+	}
+	variant := snippetVariant(t, m.injectBefore, m.alsoMatchBodyClose)
+
+	// A dry run forwards the request as the client sent it.
+	reqToForward, revalidating := req, false
+	if !m.dryRun {
+		reqToForward, revalidating = m.forwardRequest(req, variant)
+	}
+
+	sw := m.newStreamWriter(rw, req, streamOptions{
+		tracker:            t,
+		variant:            variant,
+		revalidating:       revalidating,
+		websiteIDResolvers: fromResponse,
+		cookie:             cookie,
+	})
+
+	// HTTP/1.0 clients don't expect informational responses.
+	if m.sendEarlyHints && !m.dryRun && req.Method == http.MethodGet && req.ProtoAtLeast(1, 1) && acceptsHTML(req) {
+		sendEarlyHints(rw, t.src())
 	}
 
-	sw := newStreamWriter(
-		rw,
-		m.maxLookaheadBytes,
-		m.scriptSrc,
-		websiteID,
-		m.injectBefore,
-		m.alsoMatchBodyClose,
-		m.injectOnNon2xx,
-	)
 	m.next.ServeHTTP(sw, reqToForward)
 
 	sw.finish()
 }
 
+// eligible classifies req as a page view, or returns why it is passed through.
+func (m *Middleware) eligible(req *http.Request, host string) (view pageView, reason string) {
+	switch {
+	case req.Method != http.MethodGet && req.Method != http.MethodHead:
+		return pageViewNone, "method"
+	case m.dryRun && req.Method == http.MethodHead:
+		// Deciding needs the GET body, and a dry run forwards the request as it is.
+		return pageViewNone, "head"
+	case isUpgradeRequest(req):
+		return pageViewNone, "upgrade"
+	case m.isPartialRequest(req):
+		return pageViewNone, "partial"
+	case !hostAllowed(host, m.allowedHosts):
+		return pageViewNone, "host-not-allowed"
+	case !m.fetchMetadata:
+		return pageViewDocument, ""
+	}
+
+	view = m.navigation(req)
+	if view == pageViewNone || (view == pageViewFrame && m.frameHandling == frameSkip) {
+		return view, "not-navigation"
+	}
+	return view, ""
+}
+
+// bypass hands req to the next handler untouched, recording why in the debug header. private
+// makes the response's Cache-Control private.
+func (m *Middleware) bypass(rw http.ResponseWriter, req *http.Request, reason string, private bool) {
+	if m.debugHeader != "" {
+		rw.Header().Set(m.debugHeader, debugValue("skip; reason="+reason, m.dryRun))
+	}
+	if (len(m.bypassStrip) > 0 && !m.dryRun) || private {
+		rw = &bypassWriter{ResponseWriter: rw, strip: m.bypassStrip, private: private}
+	}
+	m.next.ServeHTTP(rw, req)
+}
+
+// debugValue is the debug header value for outcome, marked if it was only a dry run.
+func debugValue(outcome string, dryRun bool) string {
+	if dryRun {
+		return outcome + "; dry-run"
+	}
+	return outcome
+}
+
+// forwardRequest returns the request to send upstream, cloning req only if it has to change. HEAD
+// goes upstream as GET: the decision needs the body, which the client then doesn't get.
+// revalidating reports that If-None-Match carried entity tags derived for variant, which were
+// translated back to their upstream form.
+func (m *Middleware) forwardRequest(req *http.Request, variant string) (fwd *http.Request, revalidating bool) {
+	set := map[string]string{}
+	if m.stripAcceptEncoding && req.Header.Get("Accept-Encoding") != "" {
+		set["Accept-Encoding"] = ""
+	}
+	// Byte offsets of an upstream 206 don't match the injected body; ask for the full page instead.
+	if m.stripRange && req.Header.Get("Range") != "" && acceptsHTML(req) {
+		set["Range"] = ""
+		set["If-Range"] = ""
+	}
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		translated, ok := translateIfNoneMatch(inm, variant)
+		if translated != inm {
+			set["If-None-Match"] = translated
+		}
+		revalidating = ok
+	}
+
+	if len(set) == 0 && req.Method != http.MethodHead {
+		return req, revalidating
+	}
+
+	cloned := req.Clone(req.Context())
+	cloned.Header = req.Header.Clone()
+	if req.Method == http.MethodHead {
+		cloned.Method = http.MethodGet
+	}
+	for name, value := range set {
+		if value == "" {
+			cloned.Header.Del(name)
+		} else {
+			cloned.Header.Set(name, value)
+		}
+	}
+	return cloned, revalidating
+}
+
+// acceptsHTML reports whether the client explicitly asks for an HTML document, as browsers do on navigations.
+func acceptsHTML(req *http.Request) bool {
+	accept := strings.ToLower(req.Header.Get("Accept"))
+	return strings.Contains(accept, "text/html") || strings.Contains(accept, "application/xhtml+xml")
+}
+
 func isUpgradeRequest(r *http.Request) bool {
 	conn := r.Header.Get("Connection")
 	upg := r.Header.Get("Upgrade")
@@ -133,18 +573,82 @@ func isUpgradeRequest(r *http.Request) bool {
 	return strings.Contains(strings.ToLower(conn), "upgrade")
 }
 
+// isPartialRequest reports whether req asks for a page fragment (htmx, Turbo Frames, pjax,
+// Unpoly). Fragments are swapped into a page that is tracked already, and may well contain
+// a </body> of their own.
+func (m *Middleware) isPartialRequest(req *http.Request) bool {
+	for _, h := range m.partialHeaders {
+		if req.Header.Get(h) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// pageView classifies a request by its fetch metadata.
+type pageView int
+
+const (
+	pageViewNone     pageView = iota // subresource, fetch(), or a skipped prefetch
+	pageViewDocument                 // top-level navigation
+	pageViewFrame                    // iframe document
+)
+
+// navigation applies the fetch metadata request headers. Requests without them (older
+// browsers, crawlers, curl) count as top-level navigations.
+func (m *Middleware) navigation(req *http.Request) pageView {
+	if !m.injectPrefetch && isSpeculative(req) {
+		return pageViewNone
+	}
+
+	dest := strings.ToLower(strings.TrimSpace(req.Header.Get("Sec-Fetch-Dest")))
+	switch dest {
+	case "document":
+		return pageViewDocument
+	case "iframe", "frame":
+		return pageViewFrame
+	case "":
+		// Without a destination, anything but a navigation is a subresource fetch.
+		if mode := req.Header.Get("Sec-Fetch-Mode"); mode != "" && !strings.EqualFold(mode, "navigate") {
+			return pageViewNone
+		}
+		return pageViewDocument
+	default:
+		// fetch()/XHR ("empty"), <object>, workers, ...
+		return pageViewNone
+	}
+}
+
+// isSpeculative reports whether req is a prefetch or prerender (Sec-Purpose, or the legacy Purpose header).
+func isSpeculative(req *http.Request) bool {
+	for _, h := range []string{"Sec-Purpose", "Purpose"} {
+		if strings.Contains(strings.ToLower(req.Header.Get(h)), "prefetch") {
+			return true
+		}
+	}
+	return false
+}
+
 type decision int
 
 const (
 	undecided decision = iota
 	passthrough
 	injecting
+	discarding // precondition failed; upstream body is dropped
 )
 
 type streamWriter struct {
 	orig http.ResponseWriter
 
-	// captured
+	// mu serializes the handler's calls with the decision timer.
+	mu sync.Mutex
+
+	// live is the header map handed to the handler. header is its snapshot taken once the
+	// status is final; decisions and the flushed response only read the snapshot, so the
+	// decision timer never touches a map the handler may still write. Trailer values are read
+	// from live, in finish.
+	live   http.Header
 	header http.Header
 	status int
 
@@ -153,49 +657,186 @@ type streamWriter struct {
 	wroteHeader    bool
 	headersFlushed bool
 	lookaheadLimit int
+	holdLimit      int // max bytes of injected output held back for an exact Content-Length
 	buf            bytes.Buffer
 
 	// injection params
-	scriptSrc          string
-	websiteID          string
+	tracker            *tracker
 	injectBefore       string
 	alsoMatchBodyClose bool
 	injectOnNon2xx     bool
+
+	// request context
+	head         bool   // HEAD: upstream answers the GET, its body is decided on but not sent
+	ifMatch      string // If-Match as sent by the client
+	variant      string // see snippetVariant
+	revalidating bool   // If-None-Match presented a tag derived for variant
+
+	earlyHintsPreload bool // add the tracker preload to upstream 103s; off for HTTP/1.0 clients
+
+	// maxDecisionDelay bounds how long output may be held back; see onDecisionTimeout.
+	maxDecisionDelay time.Duration
+	decisionTimer    *time.Timer
+
+	// flushPartialPrefix lets Flush send HTML up to a safe point while the anchor search goes on.
+	// Headers are then committed as for an injected response while the state is still undecided.
+	flushPartialPrefix bool
+
+	attributes     *responseAttributes
+	attributesRead bool
+
+	// extraHeader is added to whatever response goes out, e.g. the sampling cookie.
+	extraHeader http.Header
+
+	// private marks pages only some visitors get injected (sampling): the injected page, and any
+	// response setting the sampling cookie, stay out of shared caches.
+	private bool
+
+	// dryRun runs the decision but passes the response through; outcome is reported in debugHeader.
+	dryRun      bool
+	debugHeader string
+	outcome     string
+
+	// inspectDecoded has a dry run decide on a decompressed copy of a compressed response, as the
+	// real run would get it uncompressed by stripping Accept-Encoding.
+	inspectDecoded bool
+
+	// websiteIDResolvers read the website ID from the upstream response; the request-time ID
+	// in tracker is the fallback.
+	websiteIDResolvers []*websiteIDResolver
+	websiteIDHeaders   []string
 }
 
-func newStreamWriter(orig http.ResponseWriter, lookaheadLimit int, scriptSrc, websiteID, injectBefore string, alsoMatchBodyClose bool, injectOnNon2xx bool) *streamWriter {
+// streamOptions are the per-request inputs of a streamWriter; the rest is middleware configuration.
+type streamOptions struct {
+	tracker            *tracker
+	variant            string
+	revalidating       bool
+	websiteIDResolvers []*websiteIDResolver
+	cookie             *http.Cookie // set on whatever response goes out, nil for none
+}
+
+func (m *Middleware) newStreamWriter(orig http.ResponseWriter, req *http.Request, opts streamOptions) *streamWriter {
+	lookaheadLimit := m.maxLookaheadBytes
 	if lookaheadLimit <= 0 {
 		lookaheadLimit = 64 * 1024
 	}
 
-	return &streamWriter{
+	w := &streamWriter{
 		orig: orig,
 
-		header: make(http.Header),
+		live:   make(http.Header),
 		status: http.StatusOK,
 
 		state:          undecided,
 		lookaheadLimit: lookaheadLimit,
 
-		scriptSrc:          scriptSrc,
-		websiteID:          websiteID,
-		injectBefore:       injectBefore,
-		alsoMatchBodyClose: alsoMatchBodyClose,
-		injectOnNon2xx:     injectOnNon2xx,
+		tracker:            opts.tracker,
+		injectBefore:       m.injectBefore,
+		alsoMatchBodyClose: m.alsoMatchBodyClose,
+		injectOnNon2xx:     m.injectOnNon2xx,
+
+		head:         req.Method == http.MethodHead,
+		ifMatch:      strings.TrimSpace(req.Header.Get("If-Match")),
+		variant:      opts.variant,
+		revalidating: opts.revalidating,
+
+		earlyHintsPreload:  m.earlyHintsPreload && !m.dryRun && req.ProtoAtLeast(1, 1),
+		maxDecisionDelay:   m.maxDecisionDelay,
+		flushPartialPrefix: m.flushPartialPrefix && !m.dryRun,
+		attributes:         m.attributes,
+		dryRun:             m.dryRun,
+		debugHeader:        m.debugHeader,
+		inspectDecoded:     m.dryRun && m.stripAcceptEncoding,
+		websiteIDResolvers: opts.websiteIDResolvers,
+		websiteIDHeaders:   m.websiteIDHeaders,
+		private:            m.samplePercent < 100,
+	}
+	if opts.cookie != nil {
+		w.extraHeader = http.Header{}
+		w.extraHeader.Add("Set-Cookie", opts.cookie.String())
 	}
+	return w
 }
 
 func (w *streamWriter) Header() http.Header {
-	return w.header
+	return w.live
+}
+
+// snapshotHeader takes the header snapshot unless it exists already. Only called from the
+// handler's goroutine, with mu held.
+func (w *streamWriter) snapshotHeader() {
+	if w.header == nil {
+		w.header = w.live.Clone()
+	}
 }
 
 func (w *streamWriter) WriteHeader(statusCode int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.writeHeader(statusCode)
+}
+
+func (w *streamWriter) writeHeader(statusCode int) {
 	if w.wroteHeader {
 		return
 	}
 
+	// Informational responses go out immediately; keep waiting for the final status.
+	if statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols {
+		w.writeInformational(statusCode)
+		return
+	}
+
 	w.wroteHeader = true
 	w.status = statusCode
+	w.snapshotHeader()
+}
+
+// writeInformational forwards a 1xx response with the headers set so far, like net/http does.
+func (w *streamWriter) writeInformational(statusCode int) {
+	dst := w.orig.Header()
+	for k := range dst {
+		dst.Del(k)
+	}
+	for k, vv := range w.live {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+
+	if statusCode == http.StatusEarlyHints && w.earlyHintsPreload && !hasPreload(dst, w.tracker.src()) {
+		dst.Add("Link", preloadLink(w.tracker.src()))
+	}
+
+	w.orig.WriteHeader(statusCode)
+
+	// The final response gets w.header, not what the 1xx carried.
+	for k := range dst {
+		dst.Del(k)
+	}
+}
+
+// sendEarlyHints writes a 103 Early Hints response preloading the tracker script.
+func sendEarlyHints(rw http.ResponseWriter, scriptSrc string) {
+	h := rw.Header()
+	h.Add("Link", preloadLink(scriptSrc))
+	rw.WriteHeader(http.StatusEarlyHints)
+	h.Del("Link")
+}
+
+func preloadLink(scriptSrc string) string {
+	return "<" + scriptSrc + ">; rel=preload; as=script"
+}
+
+func hasPreload(h http.Header, scriptSrc string) bool {
+	for _, v := range h.Values("Link") {
+		if strings.Contains(v, "<"+scriptSrc+">") {
+			return true
+		}
+	}
+	return false
 }
 
 // Decide based on status + headers + (optional) sniffing.
@@ -204,6 +845,11 @@ func (w *streamWriter) htmlCandidateFromHeadersAndSniff(sample []byte) htmlCandi
 		return candidateNo
 	}
 
+	// Partial content: offsets are relative to the upstream body, never rewrite.
+	if w.status == http.StatusPartialContent || w.header.Get("Content-Range") != "" {
+		return candidateNo
+	}
+
 	ct := strings.ToLower(w.header.Get("Content-Type"))
 
 	// Explicit HTML => yes.
@@ -237,7 +883,7 @@ func sniffHTML(sample []byte) htmlCandidate {
 		sample = sample[:2048]
 	}
 
-	lower := bytes.ToLower(sample)
+	lower := asciiLower(sample)
 
 	// Trim leading whitespace (best-effort).
 	lower = bytes.TrimLeft(lower, " \t\r\n")
@@ -264,45 +910,49 @@ func sniffHTML(sample []byte) htmlCandidate {
 	return candidateMaybe
 }
 
-//nolint:funlen
 func (w *streamWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n, err := w.write(p)
+	if !w.headersFlushed && w.state != discarding {
+		w.armDecisionTimer()
+	}
+	return n, err
+}
+
+func (w *streamWriter) write(p []byte) (int, error) {
 	if !w.wroteHeader {
-		w.WriteHeader(http.StatusOK)
+		w.writeHeader(http.StatusOK)
 	}
 
 	if w.state == passthrough {
 		w.flushHeaders()
-		return w.orig.Write(p)
+		return w.send(p)
 	}
 
 	if w.state == injecting {
-		w.flushHeaders()
-		return w.orig.Write(p)
+		return w.writeInjected(p)
+	}
+
+	if w.state == discarding {
+		return len(p), nil
 	}
 
 	if len(p) == 0 {
 		return 0, nil
 	}
 
-	// Avoid corrupting compressed responses (unless you implement decompress/recompress).
-	if w.header.Get("Content-Encoding") != "" {
-		w.state = passthrough
-		w.flushHeaders()
-		w.flushBuffer()
-		return w.orig.Write(p)
+	// Avoid corrupting compressed responses (unless you implement decompress/recompress). A dry
+	// run rewrites nothing: decide inspects a decompressed copy.
+	if w.header.Get("Content-Encoding") != "" && !w.inspectDecoded {
+		w.passthrough("compressed")
+		return w.send(p)
 	}
 
-	// Buffer up to lookaheadLimit.
+	// Buffer up to lookaheadLimit. A full buffer is always decided on below, so there is room.
 	remaining := w.lookaheadLimit - w.buf.Len()
 
-	if remaining <= 0 && w.state == undecided {
-		// We can’t buffer more; fall back to passthrough.
-		w.state = passthrough
-		w.flushHeaders()
-		w.flushBuffer()
-		return w.orig.Write(p)
-	}
-
 	consumed := 0
 	if remaining > 0 {
 		if len(p) <= remaining {
@@ -314,92 +964,226 @@ func (w *streamWriter) Write(p []byte) (int, error) {
 		}
 	}
 
-	bufBytes := w.buf.Bytes()
+	// Once the lookahead is full we must decide now: inject at the best anchor or pass through.
+	if err := w.decide(w.buf.Len() >= w.lookaheadLimit); err != nil {
+		return len(p), err
+	}
 
-	// Decide if this is HTML (status + header or sniff).
-	cand := w.htmlCandidateFromHeadersAndSniff(bufBytes)
-	if cand == candidateNo {
-		w.state = passthrough
-		w.flushHeaders()
-		w.flushBuffer()
+	if w.state == undecided {
+		// Keep buffering; don't forward yet.
+		return len(p), nil
+	}
+
+	if consumed < len(p) {
+		var err error
+		if w.state == injecting {
+			_, err = w.writeInjected(p[consumed:])
+		} else {
+			_, err = w.send(p[consumed:])
+		}
+		if err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
 
-		if consumed < len(p) {
-			return w.orig.Write(p[consumed:])
+// writeInjected forwards body bytes following the injection point. Output is held back while
+// the whole response may still fit in the lookahead, so finish can send an exact Content-Length.
+func (w *streamWriter) writeInjected(p []byte) (int, error) {
+	if !w.headersFlushed {
+		if w.buf.Len()+len(p) <= w.holdLimit {
+			return w.buf.Write(p)
 		}
+		w.releaseHeld()
+	}
+	return w.send(p)
+}
+
+// send writes body bytes to the client. A HEAD response carries none.
+func (w *streamWriter) send(p []byte) (int, error) {
+	if w.head {
 		return len(p), nil
 	}
+	return w.orig.Write(p)
+}
 
-	// If already contains the script in buffered bytes, don’t inject.
-	if bytes.Contains(bufBytes, []byte(w.scriptSrc)) {
-		w.state = passthrough
-		w.flushHeaders()
-		w.flushBuffer()
+// releaseHeld sends the headers, without Content-Length, and the held injected output.
+func (w *streamWriter) releaseHeld() {
+	w.flushHeaders()
+	w.flushBuffer()
+}
 
-		if consumed < len(p) {
-			return w.orig.Write(p[consumed:])
+// decide inspects the buffered prefix and switches to passthrough or injecting when possible.
+// final reports that no more bytes will be buffered, so the decision cannot be postponed.
+func (w *streamWriter) decide(final bool) error {
+	bufBytes := w.buf.Bytes()
+	compressed := w.header.Get("Content-Encoding") != ""
+	if compressed && w.inspectDecoded {
+		if decoded, ok := decodedPrefix(w.header.Get("Content-Encoding"), bufBytes, 4*w.lookaheadLimit); ok {
+			bufBytes, compressed = decoded, false
 		}
-		return len(p), nil
+	}
+
+	// Decide if this is HTML (status + header or sniff). A flushed partial prefix was HTML already.
+	cand := w.htmlCandidateFromHeadersAndSniff(bufBytes)
+	if w.headersFlushed {
+		cand = candidateYes
+	}
+
+	if cand == candidateNo {
+		w.passthrough("not-html")
+		return nil
+	}
+	w.readResponseAttributes()
+	if w.tracker.websiteID == "" {
+		w.passthrough("no-website-id")
+		return nil
+	}
+	if compressed {
+		w.passthrough("compressed")
+		return nil
+	}
+
+	// Wait for enough bytes to tell a UTF-16 document by its BOM.
+	if len(bufBytes) < 2 && !final {
+		return nil
+	}
+
+	// Unsupported charsets can't be rewritten safely.
+	enc := detectEncoding(w.header.Get("Content-Type"), bufBytes)
+	if enc == encUnsupported {
+		w.passthrough("charset")
+		return nil
+	}
+
+	text := enc.narrow(bufBytes)
+	if w.headersFlushed {
+		cand = candidateYes
+	} else if cand == candidateMaybe && enc != encUTF8 && enc != encASCIISuperset {
+		cand = sniffHTML(text)
+	}
+
+	// If already contains the script in buffered bytes, don’t inject.
+	if bytes.Contains(text, []byte(w.tracker.scriptSrc)) {
+		w.passthrough("duplicate")
+		return nil
 	}
 
 	// If maybe, keep buffering until we can decide or hit lookahead limit.
 	if cand == candidateMaybe {
-		if w.buf.Len() >= w.lookaheadLimit {
-			w.state = passthrough
-			w.flushHeaders()
-			w.flushBuffer()
-
-			if consumed < len(p) {
-				return w.orig.Write(p[consumed:])
-			}
-			return len(p), nil
+		if final {
+			w.passthrough("not-html")
 		}
+		return nil
+	}
 
-		// Keep buffering; don't forward yet.
-		return len(p), nil
+	// AMP pages reject arbitrary scripts; leave them alone unless amp-analytics is enabled.
+	doc := w.document(enc, text)
+	if doc.amp && w.tracker.ampPixelPath == "" {
+		w.passthrough("amp")
+		return nil
 	}
 
 	// cand == candidateYes => try injection with current buffer.
-	updated, ok := tryInject(bufBytes, w.scriptSrc, w.websiteID, w.injectBefore, w.alsoMatchBodyClose)
-	if ok {
-		w.state = injecting
-		w.prepareHeadersForInjection()
-		w.flushHeaders()
-
-		_, err := w.orig.Write(updated)
-		if err != nil {
-			return len(p), err
+	updated, ok := tryInject(bufBytes, doc, w.tracker, w.injectBefore, w.alsoMatchBodyClose, final)
+	if !ok {
+		// Still HTML but couldn't inject yet; if we hit lookahead limit, give up.
+		if final {
+			w.passthrough("no-anchor")
 		}
+		return nil
+	}
 
-		if consumed < len(p) {
-			_, err2 := w.orig.Write(p[consumed:])
-			if err2 != nil {
-				return len(p), err2
-			}
-		}
+	if w.dryRun {
+		w.outcome = "inject"
+		w.passthrough("")
+		return nil
+	}
 
-		w.buf.Reset()
-		return len(p), nil
+	if w.preconditionFailed() && !w.headersFlushed {
+		w.discard(http.StatusPreconditionFailed)
+		return nil
 	}
 
-	// Still HTML but couldn't inject yet; if we hit lookahead limit, give up.
-	if w.buf.Len() >= w.lookaheadLimit {
-		w.state = passthrough
-		w.flushHeaders()
+	w.state = injecting
+	w.outcome = "inject"
+	if !w.headersFlushed {
+		w.prepareHeadersForInjection()
+	}
+	w.holdLimit = w.lookaheadLimit + len(updated) - len(bufBytes)
+	w.buf.Reset()
+	_, _ = w.buf.Write(updated)
+	if w.headersFlushed {
+		// A partial prefix went out already; there is no Content-Length to compute.
 		w.flushBuffer()
+	}
+	return nil
+}
 
-		if consumed < len(p) {
-			return w.orig.Write(p[consumed:])
-		}
-		return len(p), nil
+// document describes the buffered body for snippet rendering; text is the narrowed prefix.
+func (w *streamWriter) document(enc textEncoding, text []byte) *document {
+	d := &document{enc: enc, amp: isAMP(asciiLower(text))}
+	if strings.Contains(strings.ToLower(w.header.Get("Content-Type")), "application/xhtml+xml") {
+		d.xhtml = true
+		d.prefix = xhtmlPrefix(text)
 	}
+	return d
+}
 
-	return len(p), nil
+// preconditionFailed evaluates If-Match against the injected representation. Its entity tag
+// is weak and If-Match uses strong comparison, so only "*" can match.
+func (w *streamWriter) preconditionFailed() bool {
+	return w.ifMatch != "" && w.ifMatch != "*"
 }
 
-func (w *streamWriter) prepareHeadersForInjection() {
-	// Body changed -> strip potentially wrong validators/length.
+// discard replaces the response with an empty one carrying status and drops the upstream body.
+func (w *streamWriter) discard(status int) {
+	w.state = discarding
+	w.outcome = "precondition-failed"
+	w.status = status
 	w.header.Del("Content-Length")
+	w.header.Del("Content-Type")
 	w.header.Del("ETag")
+	w.flushHeaders()
+	w.buf.Reset()
+}
+
+// passthrough forwards the response unchanged; reason is reported in the debug header unless
+// an outcome was recorded already.
+func (w *streamWriter) passthrough(reason string) {
+	if w.outcome == "" && reason != "" {
+		w.outcome = "skip; reason=" + reason
+	}
+	w.state = passthrough
+	w.flushHeaders()
+	w.flushBuffer()
+}
+
+func (w *streamWriter) prepareHeadersForInjection() {
+	w.readResponseAttributes()
+
+	// Body changed -> strip wrong length and byte-range support, derive a validator for the rewritten body.
+	w.header.Del("Content-Length")
+	w.header.Del("Accept-Ranges")
+	w.deriveETag()
+	if w.tracker.identify != "" || w.private {
+		w.header.Set("Cache-Control", privateCacheControl(w.header.Get("Cache-Control")))
+	}
+}
+
+// deriveETag replaces the upstream ETag with the one of the injected representation.
+func (w *streamWriter) deriveETag() {
+	upstream := w.header.Get("ETag")
+	if upstream == "" {
+		return
+	}
+
+	if derived := derivedETag(upstream, w.variant); derived != "" {
+		w.header.Set("ETag", derived)
+	} else {
+		w.header.Del("ETag")
+	}
 }
 
 func (w *streamWriter) flushHeaders() {
@@ -407,18 +1191,50 @@ func (w *streamWriter) flushHeaders() {
 		return
 	}
 
+	// The client revalidated an injected copy and upstream confirmed it is still current.
+	if w.status == http.StatusNotModified && w.revalidating {
+		w.readResponseAttributes()
+		w.deriveETag()
+	}
+	if !w.dryRun {
+		w.stripResponseAttributes()
+	}
+	if w.private && w.extraHeader.Get("Set-Cookie") != "" {
+		w.header.Set("Cache-Control", privateCacheControl(w.header.Get("Cache-Control")))
+	}
+
+	// Trailer values may already be set if we flush late; they are sent after the body instead.
+	declared := declaredTrailers(w.header)
+
 	dst := w.orig.Header()
 	for k := range dst {
 		dst.Del(k)
 	}
 	for k, vv := range w.header {
+		if isTrailer(k, declared) {
+			continue
+		}
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+
+	for k, vv := range w.extraHeader {
 		for _, v := range vv {
 			dst.Add(k, v)
 		}
 	}
+	if w.debugHeader != "" && w.outcome != "" {
+		outcome := w.outcome
+		if outcome == "inject" && w.tracker.version != "" {
+			outcome += "; version=" + w.tracker.version
+		}
+		dst.Set(w.debugHeader, debugValue(outcome, w.dryRun))
+	}
 
 	w.orig.WriteHeader(w.status)
 	w.headersFlushed = true
+	w.stopDecisionTimer()
 }
 
 func (w *streamWriter) flushBuffer() {
@@ -426,63 +1242,306 @@ func (w *streamWriter) flushBuffer() {
 		return
 	}
 
-	_, _ = w.orig.Write(w.buf.Bytes())
+	_, _ = w.send(w.buf.Bytes())
 	w.buf.Reset()
 }
 
 func (w *streamWriter) finish() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.snapshotHeader()
+	w.stopDecisionTimer()
+	w.finishBody()
+	w.flushTrailers()
+}
+
+// armDecisionTimer starts the decision timer when the first bytes are held back.
+func (w *streamWriter) armDecisionTimer() {
+	if w.maxDecisionDelay <= 0 || w.decisionTimer != nil || w.buf.Len() == 0 {
+		return
+	}
+	w.decisionTimer = time.AfterFunc(w.maxDecisionDelay, w.onDecisionTimeout)
+}
+
+func (w *streamWriter) stopDecisionTimer() {
+	if w.decisionTimer != nil {
+		w.decisionTimer.Stop()
+	}
+}
+
+// onDecisionTimeout bounds time to first byte for slow upstreams: whatever is still held back
+// is decided on now (inject at the best anchor so far, or pass through) and flushed.
+func (w *streamWriter) onDecisionTimeout() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.headersFlushed || w.state == discarding {
+		return
+	}
+
 	if w.state == undecided {
-		w.state = passthrough
-		w.flushHeaders()
-		w.flushBuffer()
+		_ = w.decide(true)
+	}
+	if w.state == injecting {
+		w.releaseHeld()
+	}
+
+	if f, ok := w.orig.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *streamWriter) finishBody() {
+	if w.state == injecting && !w.headersFlushed {
+		// The complete injected body is buffered: its length is known. Trailers need chunked encoding.
+		if !hasTrailers(w.live) {
+			w.header.Set("Content-Length", strconv.Itoa(w.buf.Len()))
+		}
+		w.releaseHeld()
+		return
+	}
+
+	if w.state != undecided {
+		return
+	}
+
+	_ = w.decide(true)
+	if w.state == injecting && !w.headersFlushed {
+		w.finishBody()
+	}
+}
+
+// declaredTrailers returns the canonical names announced in the Trailer header of h.
+func declaredTrailers(h http.Header) map[string]bool {
+	declared := map[string]bool{}
+	for _, v := range h.Values("Trailer") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				declared[http.CanonicalHeaderKey(name)] = true
+			}
+		}
+	}
+	return declared
+}
+
+func hasTrailers(h http.Header) bool {
+	if h.Get("Trailer") != "" {
+		return true
+	}
+	for k := range h {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTrailer reports whether header key k carries a trailer value rather than a header.
+func isTrailer(k string, declared map[string]bool) bool {
+	return declared[k] || strings.HasPrefix(k, http.TrailerPrefix)
+}
+
+// flushTrailers copies trailer values, typically set by upstream after the body, onto the
+// original writer, which sends them once the handler returns.
+func (w *streamWriter) flushTrailers() {
+	if !w.headersFlushed || w.state == discarding || !hasTrailers(w.live) {
+		return
+	}
+
+	declared := declaredTrailers(w.live)
+	dst := w.orig.Header()
+	for k, vv := range w.live {
+		if isTrailer(k, declared) {
+			dst[k] = append([]string(nil), vv...)
+		}
+	}
+}
+
+// tracker describes the markup injected into a single response.
+type tracker struct {
+	scriptSrc string
+	websiteID string
+	pixelPath string // empty unless the noscript pixel is enabled
+	pageURI   string // page the pixel reports
+
+	ampPixelPath string // empty unless AMP pages are tracked
+	identify     string // inline umami.identify() call, empty for anonymous visitors
+	tag          string // data-tag from a response header
+	sampleTag    string // data-tag recording the sample rate
+	domains      string // data-domains, comma-separated
+	hostURL      string // data-host-url, set by environments
+	version      string // cache-busting version appended to scriptSrc
+	versionParam string
+	event        string // inline umami.track() call with response header properties
+}
+
+func (t *tracker) scriptTag(d *document) []byte {
+	script := d.qname("script")
+	attrs := ` src="` + html.EscapeString(t.src()) + `" data-website-id="` + html.EscapeString(t.websiteID) + `"`
+	if t.hostURL != "" {
+		attrs += ` data-host-url="` + html.EscapeString(t.hostURL) + `"`
+	}
+	if t.domains != "" {
+		attrs += ` data-domains="` + html.EscapeString(t.domains) + `"`
+	}
+	if tag := t.dataTag(); tag != "" {
+		attrs += ` data-tag="` + html.EscapeString(tag) + `"`
 	}
+	return []byte(`<` + script + ` ` + d.boolAttr("defer") + attrs + `></` + script + `>`)
 }
 
-// tryInject attempts injection into the provided bytes (assumed to be the beginning of HTML).
-// Returns (updated, true) if injected.
-func tryInject(prefix []byte, scriptSrc, websiteID, injectBefore string, alsoMatchBodyClose bool) ([]byte, bool) {
+// src is the script URL to emit: scriptSrc pinned to the current version, if any. Duplicate
+// detection keeps using the bare scriptSrc so pages with any version of the tracker match.
+func (t *tracker) src() string {
+	return versionedSrc(t.scriptSrc, t.versionParam, t.version)
+}
+
+// dataTag is the data-tag value: the response header value or the sample rate, never both.
+func (t *tracker) dataTag() string {
+	if t.tag != "" {
+		return t.tag
+	}
+	return t.sampleTag
+}
+
+// noscriptTag returns the pixel fallback inserted after <body>, or nil if disabled.
+// XHTML documents get none: <noscript> has no effect in XML.
+func (t *tracker) noscriptTag(d *document) []byte {
+	if t.pixelPath == "" || d.xhtml {
+		return nil
+	}
+	return []byte(`<noscript><img src="` + html.EscapeString(pixelSrc(t.pixelPath, t.websiteID, t.pageURI)) + `" alt="" width="1" height="1" style="display:none"></noscript>`)
+}
+
+// headSnippet is the markup inserted at the anchor.
+func (t *tracker) headSnippet(d *document) []byte {
+	return append(append(t.scriptTag(d), t.identifyTag(d)...), t.eventTag(d)...)
+}
+
+// tryInject attempts injection into the provided bytes (assumed to be the beginning of HTML
+// written as described by d). When the tracker carries a <body> snippet and final is false,
+// injection waits until the opening <body> tag is complete in prefix so both snippets land in
+// a single rewrite. Returns (updated, true) if injected.
+func tryInject(prefix []byte, d *document, t *tracker, injectBefore string, alsoMatchBodyClose, final bool) ([]byte, bool) {
 	if len(prefix) == 0 {
 		return nil, false
 	}
 
+	text := d.enc.narrow(prefix)
+
 	// Don’t inject twice (best-effort: check in lookahead).
-	if bytes.Contains(prefix, []byte(scriptSrc)) {
+	if bytes.Contains(text, []byte(t.scriptSrc)) {
+		return nil, false
+	}
+
+	lower := asciiLower(text)
+	if d.amp {
+		return tryInjectAMP(prefix, lower, d, t, injectBefore)
+	}
+
+	idx := bytes.Index(lower, []byte(strings.ToLower(d.qualifyTag(injectBefore))))
+	if idx < 0 && alsoMatchBodyClose {
+		idx = bytes.Index(lower, []byte(strings.ToLower(d.qualifyTag("</body>"))))
+	}
+	if idx < 0 {
 		return nil, false
 	}
 
-	snippet := []byte(`<script defer src="` + scriptSrc + `" data-website-id="` + websiteID + `"></script>`)
+	insertions := []insertion{{at: d.enc.offset(idx), snippet: d.enc.encode(t.headSnippet(d))}}
+
+	if bodySnippet := t.noscriptTag(d); bodySnippet != nil {
+		bodyIdx := bodyOpenEnd(lower, strings.ToLower(d.qualifyTag("<body")))
+		if bodyIdx < 0 && !final {
+			return nil, false
+		}
+		if bodyIdx >= 0 {
+			insertions = append(insertions, insertion{at: d.enc.offset(bodyIdx), snippet: d.enc.encode(bodySnippet)})
+		}
+	}
+
+	return splice(prefix, insertions), true
+}
+
+type insertion struct {
+	at      int
+	snippet []byte
+}
 
-	lower := bytes.ToLower(prefix)
-	target := []byte(strings.ToLower(injectBefore))
+// splice inserts the snippets into src at their offsets. Snippets sharing an offset keep their order.
+func splice(src []byte, insertions []insertion) []byte {
+	sort.SliceStable(insertions, func(i, j int) bool { return insertions[i].at < insertions[j].at })
 
-	if idx := bytes.Index(lower, target); idx >= 0 {
-		out := make([]byte, 0, len(prefix)+len(snippet))
-		out = append(out, prefix[:idx]...)
-		out = append(out, snippet...)
-		out = append(out, prefix[idx:]...)
-		return out, true
+	size := len(src)
+	for _, ins := range insertions {
+		size += len(ins.snippet)
 	}
 
-	if alsoMatchBodyClose {
-		if idx := bytes.Index(lower, []byte("</body>")); idx >= 0 {
-			out := make([]byte, 0, len(prefix)+len(snippet))
-			out = append(out, prefix[:idx]...)
-			out = append(out, snippet...)
-			out = append(out, prefix[idx:]...)
-			return out, true
+	out := make([]byte, 0, size)
+	last := 0
+	for _, ins := range insertions {
+		out = append(out, src[last:ins.at]...)
+		out = append(out, ins.snippet...)
+		last = ins.at
+	}
+	return append(out, src[last:]...)
+}
+
+// bodyOpenEnd returns the offset just past the '>' of the first open tag (e.g. "<body") in
+// lower, or -1 if the tag is absent or not complete yet. lower must already be lowercased.
+func bodyOpenEnd(lower []byte, open string) int {
+	from := 0
+	for {
+		i := bytes.Index(lower[from:], []byte(open))
+		if i < 0 {
+			return -1
 		}
+		i += from + len(open)
+		if i >= len(lower) {
+			return -1
+		}
+
+		switch lower[i] {
+		case '>', '/', ' ', '\t', '\r', '\n', '\f':
+			return tagEnd(lower, i)
+		}
+		from = i
 	}
+}
 
-	return nil, false
+// tagEnd returns the offset just past the '>' closing the tag whose attributes start at from,
+// skipping quoted attribute values, or -1 if the tag is not complete in b.
+func tagEnd(b []byte, from int) int {
+	var quote byte
+	for i := from; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i + 1
+		}
+	}
+	return -1
 }
 
-// Flush implements http.Flusher. If we haven't decided yet whether to inject,
-// we fall back to passthrough before flushing to avoid partial/invalid rewrites.
+// Flush implements http.Flusher. If we haven't decided yet whether to inject, we inject at
+// the best anchor buffered so far; without one we fall back to passthrough (or, with
+// flushPartialPrefix, flush a safe prefix and keep searching) to avoid partial/invalid rewrites.
 func (w *streamWriter) Flush() {
-	if w.state == undecided {
-		w.state = passthrough
-		w.flushHeaders()
-		w.flushBuffer()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.snapshotHeader()
+	if w.state == undecided && !w.flushSafePrefix() {
+		_ = w.decide(true)
+	}
+	if w.state == injecting {
+		w.releaseHeld()
 	}
 
 	if f, ok := w.orig.(http.Flusher); ok {
@@ -490,18 +1549,191 @@ func (w *streamWriter) Flush() {
 	}
 }
 
+// flushSafePrefix sends the buffered HTML up to the last point where no anchor, <body> tag or
+// script URL can start, keeping the rest buffered. It reports false when flushPartialPrefix is
+// off or injection should be decided right away instead.
+func (w *streamWriter) flushSafePrefix() bool {
+	if !w.flushPartialPrefix {
+		return false
+	}
+
+	bufBytes := w.buf.Bytes()
+	if !w.headersFlushed {
+		if w.htmlCandidateFromHeadersAndSniff(bufBytes) != candidateYes || w.header.Get("Content-Encoding") != "" || w.preconditionFailed() {
+			return false
+		}
+	}
+	// Cut points are computed on bytes: only for ASCII-compatible documents.
+	enc := detectEncoding(w.header.Get("Content-Type"), bufBytes)
+	if enc != encUTF8 && enc != encASCIISuperset {
+		return false
+	}
+	if bytes.Contains(bufBytes, []byte(w.tracker.scriptSrc)) {
+		return false
+	}
+	if _, ok := tryInject(bufBytes, w.document(enc, bufBytes), w.tracker, w.injectBefore, w.alsoMatchBodyClose, true); ok {
+		return false
+	}
+
+	// Keep an unterminated tag (a partial anchor or <body ...>) and a partial script URL.
+	cut := len(bufBytes)
+	if lt := bytes.LastIndexByte(bufBytes, '<'); lt >= 0 && bytes.IndexByte(bufBytes[lt:], '>') < 0 {
+		cut = lt
+	}
+	if n := len(bufBytes) - suffixPrefixLen(bufBytes, []byte(w.tracker.scriptSrc)); n < cut {
+		cut = n
+	}
+
+	if !w.headersFlushed {
+		w.prepareHeadersForInjection()
+		w.flushHeaders()
+	}
+	if cut > 0 {
+		_, _ = w.send(bufBytes[:cut])
+		w.buf.Next(cut)
+	}
+	return true
+}
+
 func (w *streamWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	h, ok := w.orig.(http.Hijacker)
 	if !ok {
 		return nil, nil, http.ErrNotSupported
 	}
 
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.snapshotHeader()
 	// If hijacking occurs, we must flush what we have and stop rewriting.
 	if w.state == undecided {
-		w.state = passthrough
-		w.flushHeaders()
-		w.flushBuffer()
+		w.passthrough("hijacked")
+	}
+	if w.state == injecting {
+		w.releaseHeld()
 	}
 
 	return h.Hijack()
 }
+
+// suffixPrefixLen returns the length of the longest proper prefix of needle that b ends with.
+func suffixPrefixLen(b, needle []byte) int {
+	n := len(needle) - 1
+	if n > len(b) {
+		n = len(b)
+	}
+	for ; n > 0; n-- {
+		if bytes.HasSuffix(b, needle[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// Unwrap returns the wrapped writer, for http.ResponseController. Capabilities that touch the
+// body (Flush, Hijack, ReadFrom) are implemented by streamWriter itself so they stay subject to
+// the injection state machine; the controller only unwraps for what we don't implement.
+func (w *streamWriter) Unwrap() http.ResponseWriter {
+	return w.orig
+}
+
+// ReadFrom implements io.ReaderFrom. Bytes go through Write while they may still be rewritten;
+// once output streams straight through, the rest is handed to the original writer's ReadFrom
+// (e.g. sendfile).
+func (w *streamWriter) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	chunk := make([]byte, 32*1024)
+	for !w.isStreaming() {
+		nr, er := r.Read(chunk)
+		if nr > 0 {
+			nw, ew := w.Write(chunk[:nr])
+			n += int64(nw)
+			if ew != nil {
+				return n, ew
+			}
+		}
+		if errors.Is(er, io.EOF) {
+			return n, nil
+		}
+		if er != nil {
+			return n, er
+		}
+	}
+
+	var m int64
+	var err error
+	if w.head {
+		m, err = io.Copy(io.Discard, r)
+	} else if rf, ok := w.orig.(io.ReaderFrom); ok {
+		m, err = rf.ReadFrom(r)
+	} else {
+		m, err = io.Copy(w.orig, r)
+	}
+	return n + m, err
+}
+
+// isStreaming reports that body bytes are now forwarded unmodified to the original writer.
+func (w *streamWriter) isStreaming() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.headersFlushed && (w.state == passthrough || w.state == injecting)
+}
+
+// Push implements http.Pusher when the original writer supports HTTP/2 server push.
+func (w *streamWriter) Push(target string, opts *http.PushOptions) error {
+	return pushVia(w.orig, target, opts)
+}
+
+// SetReadDeadline forwards to the first writer in the Unwrap chain that supports it.
+func (w *streamWriter) SetReadDeadline(deadline time.Time) error {
+	return setReadDeadlineVia(w.orig, deadline)
+}
+
+// SetWriteDeadline forwards to the first writer in the Unwrap chain that supports it.
+func (w *streamWriter) SetWriteDeadline(deadline time.Time) error {
+	return setWriteDeadlineVia(w.orig, deadline)
+}
+
+// pushVia pushes target through rw if it supports HTTP/2 server push.
+func pushVia(rw http.ResponseWriter, target string, opts *http.PushOptions) error {
+	if p, ok := rw.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+type readDeadliner interface {
+	SetReadDeadline(deadline time.Time) error
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(deadline time.Time) error
+}
+
+// setReadDeadlineVia sets the read deadline on the first writer in rw's Unwrap chain that supports it.
+func setReadDeadlineVia(rw http.ResponseWriter, deadline time.Time) error {
+	for ; rw != nil; rw = unwrap(rw) {
+		if d, ok := rw.(readDeadliner); ok {
+			return d.SetReadDeadline(deadline)
+		}
+	}
+	return http.ErrNotSupported
+}
+
+// setWriteDeadlineVia sets the write deadline on the first writer in rw's Unwrap chain that supports it.
+func setWriteDeadlineVia(rw http.ResponseWriter, deadline time.Time) error {
+	for ; rw != nil; rw = unwrap(rw) {
+		if d, ok := rw.(writeDeadliner); ok {
+			return d.SetWriteDeadline(deadline)
+		}
+	}
+	return http.ErrNotSupported
+}
+
+func unwrap(rw http.ResponseWriter) http.ResponseWriter {
+	if u, ok := rw.(interface{ Unwrap() http.ResponseWriter }); ok {
+		return u.Unwrap()
+	}
+	return nil
+}
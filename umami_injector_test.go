@@ -3,10 +3,19 @@ package traefikumamitaginjector
 import (
 	"bytes"
 	"context"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func newTestMiddleware(t *testing.T, next http.Handler, cfg *Config) http.Handler {
@@ -36,6 +45,29 @@ func mustNotContain(t *testing.T, haystack, needle, msg string) {
 	}
 }
 
+// helloPage is a minimal injectable page.
+const helloPage = "<html><head></head><body>Hello</body></html>"
+
+// serveHTML serves page as UTF-8 HTML through the middleware for cfg. respHeaders are set on the
+// upstream response; empty values are left out.
+func serveHTML(t *testing.T, cfg *Config, req *http.Request, page string, respHeaders map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		for k, v := range respHeaders {
+			if v != "" {
+				rw.Header().Set(k, v)
+			}
+		}
+		_, _ = rw.Write([]byte(page))
+	})
+
+	rr := httptest.NewRecorder()
+	newTestMiddleware(t, next, cfg).ServeHTTP(rr, req)
+	return rr
+}
+
 func scriptSnippet(src, websiteID string) string {
 	return `<script defer src="` + src + `" data-website-id="` + websiteID + `"></script>`
 }
@@ -60,6 +92,157 @@ func Test_Passthrough_WhenNotGET(t *testing.T) {
 	mustNotContain(t, rr.Body.String(), cfg.ScriptSrc, "non-GET should passthrough")
 }
 
+func Test_Passthrough_PartialPageRequests(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = rw.Write([]byte("<div id=\"frame\">Hello</div></body>"))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	mw := newTestMiddleware(t, next, cfg)
+
+	for _, h := range []string{"HX-Request", "Turbo-Frame", "X-PJAX", "X-Up-Target"} {
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		req.Header.Set(h, "true")
+		rr := httptest.NewRecorder()
+
+		mw.ServeHTTP(rr, req)
+
+		mustNotContain(t, rr.Body.String(), cfg.ScriptSrc, h+" fragment should passthrough")
+	}
+
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+	mustContain(t, rr.Body.String(), cfg.ScriptSrc, "full page request should still be injected")
+}
+
+func Test_PartialPageRequests_Configurable(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = rw.Write([]byte("<html><head></head><body>Hello</body></html>"))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.PartialRequestHeaders = []string{"X-Fragment"}
+	mw := newTestMiddleware(t, next, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.Header.Set("X-Fragment", "1")
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, req)
+	mustNotContain(t, rr.Body.String(), cfg.ScriptSrc, "custom header should mark a fragment")
+
+	req = httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.Header.Set("HX-Request", "true")
+	rr = httptest.NewRecorder()
+	mw.ServeHTTP(rr, req)
+	mustContain(t, rr.Body.String(), cfg.ScriptSrc, "replaced list should no longer match HX-Request")
+
+	cfg.SkipPartialRequests = false
+	mw = newTestMiddleware(t, next, cfg)
+	req = httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.Header.Set("X-Fragment", "1")
+	rr = httptest.NewRecorder()
+	mw.ServeHTTP(rr, req)
+	mustContain(t, rr.Body.String(), cfg.ScriptSrc, "skipPartialRequests=false should inject")
+}
+
+func Test_FetchMetadata_Eligibility(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = rw.Write([]byte("<html><head></head><body>Hello</body></html>"))
+	})
+
+	cases := []struct {
+		name    string
+		headers map[string]string
+		frame   string
+		want    string // injected website ID, "" for passthrough
+	}{
+		{"no metadata", nil, "", "uuid"},
+		{"top-level navigation", map[string]string{"Sec-Fetch-Dest": "document", "Sec-Fetch-Mode": "navigate"}, "", "uuid"},
+		{"fetch", map[string]string{"Sec-Fetch-Dest": "empty", "Sec-Fetch-Mode": "cors"}, "", ""},
+		{"non-navigation without dest", map[string]string{"Sec-Fetch-Mode": "no-cors"}, "", ""},
+		{"iframe skipped by default", map[string]string{"Sec-Fetch-Dest": "iframe"}, "", ""},
+		{"iframe injected", map[string]string{"Sec-Fetch-Dest": "iframe"}, frameInject, "uuid"},
+		{"iframe separate ID", map[string]string{"Sec-Fetch-Dest": "iframe"}, frameSeparate, "uuid-frame"},
+		{"prefetch", map[string]string{"Sec-Fetch-Dest": "document", "Sec-Purpose": "prefetch"}, "", ""},
+		{"prerender", map[string]string{"Sec-Fetch-Dest": "document", "Sec-Purpose": "prefetch;prerender"}, "", ""},
+		{"legacy purpose", map[string]string{"Purpose": "prefetch"}, "", ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.WebsiteID = "uuid"
+			if tc.frame != "" {
+				cfg.FrameHandling = tc.frame
+				cfg.FrameWebsiteID = "uuid-frame"
+			}
+			mw := newTestMiddleware(t, next, cfg)
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			mw.ServeHTTP(rr, req)
+
+			if tc.want == "" {
+				mustNotContain(t, rr.Body.String(), cfg.ScriptSrc, "expected passthrough")
+				return
+			}
+			mustContain(t, rr.Body.String(), scriptSnippet(cfg.ScriptSrc, tc.want), "expected injection")
+		})
+	}
+}
+
+func Test_FetchMetadata_Configurable(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = rw.Write([]byte("<html><head></head><body>Hello</body></html>"))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.PrefetchHandling = prefetchInject
+	mw := newTestMiddleware(t, next, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.Header.Set("Sec-Fetch-Dest", "document")
+	req.Header.Set("Sec-Purpose", "prefetch")
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, req)
+	mustContain(t, rr.Body.String(), cfg.ScriptSrc, "prefetchHandling=inject should inject prefetches")
+
+	cfg = CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.RespectFetchMetadata = false
+	mw = newTestMiddleware(t, next, cfg)
+
+	req = httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.Header.Set("Sec-Fetch-Dest", "iframe")
+	rr = httptest.NewRecorder()
+	mw.ServeHTTP(rr, req)
+	mustContain(t, rr.Body.String(), cfg.ScriptSrc, "respectFetchMetadata=false should ignore the headers")
+}
+
+func Test_FetchMetadata_InvalidConfig(t *testing.T) {
+	for _, mutate := range []func(*Config){
+		func(c *Config) { c.FrameHandling = "maybe" },
+		func(c *Config) { c.FrameHandling = frameSeparate },
+		func(c *Config) { c.PrefetchHandling = "sometimes" },
+	} {
+		cfg := CreateConfig()
+		mutate(cfg)
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+			t.Fatalf("expected a configuration error for %+v", cfg)
+		}
+	}
+}
+
 func Test_ConfigWebsiteID_TakesPrecedence_OverHeader_AndDefault(t *testing.T) {
 	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
 		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -332,8 +515,8 @@ func Test_HeaderCleanup_OnInjection(t *testing.T) {
 	if rr.Header().Get("ETag") != "" {
 		t.Fatalf("expected ETag removed after injection")
 	}
-	if rr.Header().Get("Content-Length") != "" {
-		t.Fatalf("expected Content-Length removed after injection")
+	if got, want := rr.Header().Get("Content-Length"), strconv.Itoa(rr.Body.Len()); got != want {
+		t.Fatalf("expected upstream Content-Length replaced by exact length %s, got %q", want, got)
 	}
 }
 
@@ -450,3 +633,1033 @@ func Test_StripAcceptEncoding_False_DoesNotStripHeaderBeforeUpstream(t *testing.
 	}
 	mustContain(t, rr.Body.String(), cfg.ScriptSrc, "expected injection")
 }
+
+func Test_Head_MirrorsInjectedGetHeaders(t *testing.T) {
+	const page = "<html><head></head><body>Hello</body></html>"
+	var methods []string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		methods = append(methods, req.Method)
+		rw.Header().Set("ETag", `"abc"`)
+		rw.Header().Set("Content-Length", strconv.Itoa(len(page)))
+		rw.Header().Set("Content-Type", "text/html")
+		rw.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			_, _ = rw.Write([]byte(page))
+		}
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.NoscriptPixel = true
+
+	mw := newTestMiddleware(t, next, cfg)
+
+	get := httptest.NewRecorder()
+	mw.ServeHTTP(get, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+	head := httptest.NewRecorder()
+	mw.ServeHTTP(head, httptest.NewRequest(http.MethodHead, "https://example.com/", nil))
+
+	if methods[1] != http.MethodGet {
+		t.Fatalf("HEAD should reach upstream as GET, got %s", methods[1])
+	}
+	if head.Code != http.StatusOK || head.Body.Len() != 0 {
+		t.Fatalf("expected 200 without a body, got %d %q", head.Code, head.Body.String())
+	}
+	if !strings.HasPrefix(head.Header().Get("ETag"), `W/"abc-umami-`) || head.Header().Get("ETag") != get.Header().Get("ETag") {
+		t.Fatalf("expected HEAD to adjust validators like an injected GET, got HEAD=%v GET=%v", head.Header(), get.Header())
+	}
+	if cl := get.Header().Get("Content-Length"); cl != strconv.Itoa(get.Body.Len()) || head.Header().Get("Content-Length") != cl {
+		t.Fatalf("expected HEAD Content-Length to match the injected GET (%d bytes), got HEAD=%q GET=%q",
+			get.Body.Len(), head.Header().Get("Content-Length"), cl)
+	}
+}
+
+func Test_Head_ContentLength_MatchesGet(t *testing.T) {
+	cases := map[string]struct {
+		contentType string
+		body        []byte
+	}{
+		"no-anchor": {"text/html", []byte("<p>fragment without head or body</p>")},
+		"duplicate": {"text/html", []byte("<html><head>" + scriptSnippet("https://analytics.example.com/script.js", "uuid") + "</head><body></body></html>")},
+		"amp":       {"text/html", []byte("<html amp><head></head><body>Hello</body></html>")},
+		"utf-16":    {"text/html", encodeUTF16("<html><head></head><body>Hallo</body></html>", false, true)},
+		"injected":  {"text/html", []byte("<html><head></head><body>Hello</body></html>")},
+	}
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.ScriptSrc = "https://analytics.example.com/script.js"
+	cfg.NoscriptPixel = true
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				rw.Header().Set("Content-Type", tc.contentType)
+				rw.Header().Set("Content-Length", strconv.Itoa(len(tc.body)))
+				_, _ = rw.Write(tc.body)
+			})
+			mw := newTestMiddleware(t, next, cfg)
+
+			get := httptest.NewRecorder()
+			mw.ServeHTTP(get, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+			head := httptest.NewRecorder()
+			mw.ServeHTTP(head, httptest.NewRequest(http.MethodHead, "https://example.com/", nil))
+
+			if cl := get.Header().Get("Content-Length"); cl != strconv.Itoa(get.Body.Len()) || head.Header().Get("Content-Length") != cl {
+				t.Fatalf("expected HEAD Content-Length to match the GET body (%d bytes), got HEAD=%q GET=%q",
+					get.Body.Len(), head.Header().Get("Content-Length"), cl)
+			}
+		})
+	}
+}
+
+func Test_Head_IfMatch_FollowsGetDecision(t *testing.T) {
+	// The page carries the tracker already: GET passes it through and If-Match applies upstream.
+	page := "<html><head>" + scriptSnippet("/umami.js", "uuid") + "</head><body>Hello</body></html>"
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("ETag", `"abc"`)
+		rw.Header().Set("Content-Type", "text/html")
+		_, _ = rw.Write([]byte(page))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.ScriptSrc = "/umami.js"
+
+	mw := newTestMiddleware(t, next, cfg)
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		req := httptest.NewRequest(method, "https://example.com/", nil)
+		req.Header.Set("If-Match", `"abc"`)
+		rr := httptest.NewRecorder()
+
+		mw.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK || rr.Header().Get("ETag") != `"abc"` {
+			t.Fatalf("%s: expected the untouched 200, got %d %v", method, rr.Code, rr.Header())
+		}
+	}
+}
+
+func Test_Head_DropsContentLength_BeyondLookahead(t *testing.T) {
+	page := "<html><head></head><body>" + strings.Repeat("x", 128*1024) + "</body></html>"
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Length", strconv.Itoa(len(page)))
+		rw.Header().Set("Content-Type", "text/html")
+		_, _ = rw.Write([]byte(page))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+
+	mw := newTestMiddleware(t, next, cfg)
+
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, httptest.NewRequest(http.MethodHead, "https://example.com/", nil))
+
+	if rr.Header().Get("Content-Length") != "" || rr.Body.Len() != 0 {
+		t.Fatalf("a page larger than the lookahead streams without a length, got %q", rr.Header().Get("Content-Length"))
+	}
+}
+
+func Test_Head_KeepsHeaders_WhenNotHTML(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("ETag", `"abc"`)
+		rw.Header().Set("Content-Length", "11")
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+
+	mw := newTestMiddleware(t, next, cfg)
+
+	req := httptest.NewRequest(http.MethodHead, "https://example.com/api", nil)
+	rr := httptest.NewRecorder()
+
+	mw.ServeHTTP(rr, req)
+
+	if rr.Header().Get("ETag") != `"abc"` || rr.Header().Get("Content-Length") != "11" {
+		t.Fatalf("expected non-HTML HEAD untouched, got headers=%v", rr.Header())
+	}
+}
+
+func Test_IfMatch_FailsAgainstInjectedRepresentation(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("ETag", `"abc"`)
+		rw.Header().Set("Content-Type", "text/html")
+		_, _ = rw.Write([]byte("<html><head></head></html>"))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+
+	mw := newTestMiddleware(t, next, cfg)
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		req := httptest.NewRequest(method, "https://example.com/", nil)
+		req.Header.Set("If-Match", `"abc"`)
+		rr := httptest.NewRecorder()
+
+		mw.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusPreconditionFailed {
+			t.Fatalf("%s: expected 412, got %d", method, rr.Code)
+		}
+		if rr.Body.Len() != 0 {
+			t.Fatalf("%s: expected empty body, got %q", method, rr.Body.String())
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.Header.Set("If-Match", "*")
+	rr := httptest.NewRecorder()
+
+	mw.ServeHTTP(rr, req)
+
+	mustContain(t, rr.Body.String(), cfg.ScriptSrc, "If-Match: * should still be served and injected")
+}
+
+const rangePage = "<html><head></head><body>0123456789abcdefghij</body></html>"
+
+func rangeUpstream(sawRange *string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		*sawRange = r.Header.Get("Range")
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		http.ServeContent(rw, r, "index.html", time.Time{}, strings.NewReader(rangePage))
+	})
+}
+
+func Test_Range_StrippedForHTMLNavigation_ByDefault(t *testing.T) {
+	var sawRange string
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+
+	mw := newTestMiddleware(t, rangeUpstream(&sawRange), cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("Range", "bytes=0-5,30-40")
+	rr := httptest.NewRecorder()
+
+	mw.ServeHTTP(rr, req)
+
+	if sawRange != "" {
+		t.Fatalf("expected Range stripped before upstream, got %q", sawRange)
+	}
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected full 200, got %d", rr.Code)
+	}
+	mustContain(t, rr.Body.String(), scriptSnippet(cfg.ScriptSrc, "uuid"), "full page should be injected")
+	if rr.Header().Get("Accept-Ranges") != "" {
+		t.Fatalf("expected Accept-Ranges removed from injected page")
+	}
+}
+
+func Test_Range_KeptForNonNavigation_InStripMode(t *testing.T) {
+	var sawRange string
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+
+	mw := newTestMiddleware(t, rangeUpstream(&sawRange), cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.Header.Set("Accept", "*/*")
+	req.Header.Set("Range", "bytes=0-5")
+	rr := httptest.NewRecorder()
+
+	mw.ServeHTTP(rr, req)
+
+	if sawRange != "bytes=0-5" {
+		t.Fatalf("expected Range forwarded for non-navigation, got %q", sawRange)
+	}
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != rangePage[:6] {
+		t.Fatalf("expected untouched 206, got %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func Test_Range_PassthroughMode_NeverTouchesMultiRange206(t *testing.T) {
+	var sawRange string
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.RangeHandling = "passthrough"
+	cfg.InjectOnNon2xx = true
+
+	mw := newTestMiddleware(t, rangeUpstream(&sawRange), cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("Range", "bytes=0-5,30-40")
+	rr := httptest.NewRecorder()
+
+	mw.ServeHTTP(rr, req)
+
+	if sawRange != "bytes=0-5,30-40" {
+		t.Fatalf("expected Range forwarded in passthrough mode, got %q", sawRange)
+	}
+	if rr.Code != http.StatusPartialContent {
+		t.Fatalf("expected 206, got %d", rr.Code)
+	}
+
+	_, params, err := mime.ParseMediaType(rr.Header().Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("parse Content-Type: %v", err)
+	}
+
+	mr := multipart.NewReader(rr.Body, params["boundary"])
+	wantParts := []string{rangePage[0:6], rangePage[30:41]}
+	for i, want := range wantParts {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		got, _ := io.ReadAll(part)
+		if string(got) != want {
+			t.Fatalf("part %d: expected %q, got %q", i, want, got)
+		}
+	}
+	if _, err := mr.NextPart(); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected exactly two parts, got err=%v", err)
+	}
+}
+
+func Test_Range_SingleRange206WithHTMLContentType_IsNotInjected(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		rw.Header().Set("Content-Range", "bytes 0-25/100")
+		rw.WriteHeader(http.StatusPartialContent)
+		_, _ = rw.Write([]byte("<html><head></head><body>"))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.RangeHandling = "passthrough"
+
+	mw := newTestMiddleware(t, next, cfg)
+
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+	mustNotContain(t, rr.Body.String(), cfg.ScriptSrc, "206 must never be rewritten")
+}
+
+func Test_Range_InvalidHandling_IsRejected(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.RangeHandling = "sometimes"
+
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Fatalf("expected error for unknown rangeHandling")
+	}
+}
+
+func Test_ContentLength_ExactForFullyBufferedResponse_OverTheWire(t *testing.T) {
+	page := "<html><head></head><body>small</body></html>"
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		rw.Header().Set("Content-Length", strconv.Itoa(len(page)))
+		_, _ = rw.Write([]byte(page[:10]))
+		_, _ = rw.Write([]byte(page[10:]))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+
+	srv := httptest.NewServer(newTestMiddleware(t, next, cfg))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.ContentLength != int64(len(body)) || len(resp.TransferEncoding) != 0 {
+		t.Fatalf("expected exact Content-Length %d without chunking, got %d %v", len(body), resp.ContentLength, resp.TransferEncoding)
+	}
+	mustContain(t, string(body), scriptSnippet(cfg.ScriptSrc, "uuid"), "expected injection")
+}
+
+func Test_ContentLength_DroppedWhenBodyExceedsLookahead(t *testing.T) {
+	tail := bytes.Repeat([]byte("z"), 4096)
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		_, _ = rw.Write([]byte("<html><head></head><body>"))
+		_, _ = rw.Write(tail)
+		_, _ = rw.Write([]byte("</body></html>"))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.MaxLookaheadBytes = 1024
+
+	mw := newTestMiddleware(t, next, cfg)
+
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+	if rr.Header().Get("Content-Length") != "" {
+		t.Fatalf("expected no Content-Length once output exceeds the lookahead")
+	}
+	want := "<html><head>" + scriptSnippet(cfg.ScriptSrc, "uuid") + "</head><body>" + string(tail) + "</body></html>"
+	if rr.Body.String() != want {
+		t.Fatalf("unexpected body, got len=%d want len=%d", rr.Body.Len(), len(want))
+	}
+}
+
+func Test_ContentLength_UpstreamFlushReleasesHeldOutput(t *testing.T) {
+	var flushedBeforeReturn bool
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		_, _ = rw.Write([]byte("<html><head></head><body>"))
+		rw.(http.Flusher).Flush()
+		flushedBeforeReturn = strings.Contains(rw.(*streamWriter).orig.(*httptest.ResponseRecorder).Body.String(), "<body>")
+		_, _ = rw.Write([]byte("</body></html>"))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+
+	mw := newTestMiddleware(t, next, cfg)
+
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+	if !flushedBeforeReturn {
+		t.Fatalf("expected Flush to release held injected output")
+	}
+	if rr.Header().Get("Content-Length") != "" {
+		t.Fatalf("expected no Content-Length after an early flush")
+	}
+	mustContain(t, rr.Body.String(), scriptSnippet(cfg.ScriptSrc, "uuid"), "expected injection")
+}
+
+// capabilityWriter is an original writer exposing the optional interfaces a real server offers.
+type capabilityWriter struct {
+	*httptest.ResponseRecorder
+
+	readFromCalls int
+	pushed        []string
+}
+
+func (c *capabilityWriter) ReadFrom(r io.Reader) (int64, error) {
+	c.readFromCalls++
+	return io.Copy(c.ResponseRecorder, r)
+}
+
+func (c *capabilityWriter) Push(target string, _ *http.PushOptions) error {
+	c.pushed = append(c.pushed, target)
+	return nil
+}
+
+// deadlineWriter sits below an intermediate wrapper to exercise Unwrap chains.
+type deadlineWriter struct {
+	http.ResponseWriter
+
+	read, write time.Time
+}
+
+func (d *deadlineWriter) SetReadDeadline(t time.Time) error {
+	d.read = t
+	return nil
+}
+
+func (d *deadlineWriter) SetWriteDeadline(t time.Time) error {
+	d.write = t
+	return nil
+}
+
+type unwrappingWriter struct {
+	http.ResponseWriter
+}
+
+func (u unwrappingWriter) Unwrap() http.ResponseWriter {
+	return u.ResponseWriter
+}
+
+func Test_Interfaces_UnwrapReturnsOriginalWriter(t *testing.T) {
+	rr := httptest.NewRecorder()
+
+	var got http.ResponseWriter
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		got = rw.(interface{ Unwrap() http.ResponseWriter }).Unwrap()
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+
+	newTestMiddleware(t, next, cfg).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+	if got != rr {
+		t.Fatalf("expected Unwrap to return the original writer")
+	}
+}
+
+func Test_Interfaces_ReadFrom_InjectsThenDelegates(t *testing.T) {
+	tail := strings.Repeat("z", 8192)
+	page := "<html><head></head><body>" + tail + "</body></html>"
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		if _, ok := rw.(io.ReaderFrom); !ok {
+			t.Fatalf("expected io.ReaderFrom through the middleware")
+		}
+		// Hide strings.Reader's WriterTo so io.Copy goes through ReadFrom.
+		_, _ = io.Copy(rw, struct{ io.Reader }{strings.NewReader(page)})
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.MaxLookaheadBytes = 1024
+
+	cw := &capabilityWriter{ResponseRecorder: httptest.NewRecorder()}
+	newTestMiddleware(t, next, cfg).ServeHTTP(cw, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+	want := "<html><head>" + scriptSnippet(cfg.ScriptSrc, "uuid") + "</head><body>" + tail + "</body></html>"
+	if cw.Body.String() != want {
+		t.Fatalf("unexpected body, got len=%d want len=%d", cw.Body.Len(), len(want))
+	}
+	if cw.readFromCalls != 1 {
+		t.Fatalf("expected the remainder to use the original ReadFrom, got %d calls", cw.readFromCalls)
+	}
+}
+
+func Test_Interfaces_ReadFrom_PassthroughUsesOriginalReadFrom(t *testing.T) {
+	payload := strings.Repeat(`{"k":1}`, 1000)
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		_, _ = rw.(io.ReaderFrom).ReadFrom(strings.NewReader(payload))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+
+	cw := &capabilityWriter{ResponseRecorder: httptest.NewRecorder()}
+	newTestMiddleware(t, next, cfg).ServeHTTP(cw, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+	if cw.Body.String() != payload {
+		t.Fatalf("expected payload unchanged")
+	}
+	if cw.readFromCalls != 1 {
+		t.Fatalf("expected original ReadFrom to be used, got %d calls", cw.readFromCalls)
+	}
+}
+
+func Test_Interfaces_PushIsForwarded(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		if err := rw.(http.Pusher).Push("/style.css", nil); err != nil {
+			t.Fatalf("Push: %v", err)
+		}
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+
+	cw := &capabilityWriter{ResponseRecorder: httptest.NewRecorder()}
+	newTestMiddleware(t, next, cfg).ServeHTTP(cw, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+	if len(cw.pushed) != 1 || cw.pushed[0] != "/style.css" {
+		t.Fatalf("expected push forwarded, got %v", cw.pushed)
+	}
+
+	next = http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		if err := rw.(http.Pusher).Push("/style.css", nil); !errors.Is(err, http.ErrNotSupported) {
+			t.Fatalf("expected ErrNotSupported without a pusher, got %v", err)
+		}
+	})
+	newTestMiddleware(t, next, cfg).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+}
+
+func Test_Interfaces_DeadlinesFollowUnwrapChain(t *testing.T) {
+	readAt := time.Unix(1700000000, 0)
+	writeAt := readAt.Add(time.Minute)
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		if err := rw.(readDeadliner).SetReadDeadline(readAt); err != nil {
+			t.Fatalf("SetReadDeadline: %v", err)
+		}
+		if err := rw.(writeDeadliner).SetWriteDeadline(writeAt); err != nil {
+			t.Fatalf("SetWriteDeadline: %v", err)
+		}
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+
+	dw := &deadlineWriter{ResponseWriter: httptest.NewRecorder()}
+	newTestMiddleware(t, next, cfg).ServeHTTP(unwrappingWriter{dw}, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+	if !dw.read.Equal(readAt) || !dw.write.Equal(writeAt) {
+		t.Fatalf("expected deadlines forwarded, got read=%v write=%v", dw.read, dw.write)
+	}
+
+	next = http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		if err := rw.(readDeadliner).SetReadDeadline(readAt); !errors.Is(err, http.ErrNotSupported) {
+			t.Fatalf("expected ErrNotSupported, got %v", err)
+		}
+	})
+	newTestMiddleware(t, next, cfg).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+}
+
+type informational struct {
+	code   int
+	header textproto.MIMEHeader
+}
+
+// getWithInformational performs a GET against url recording every 1xx response.
+func getWithInformational(t *testing.T, url string, accept string) (*http.Response, []informational) {
+	t.Helper()
+
+	var got []informational
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			got = append(got, informational{code: code, header: header})
+			return nil
+		},
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+
+	return resp, got
+}
+
+func Test_EarlyHints_ForwardedAndFinalResponseStillInjected(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		rw.WriteHeader(http.StatusEarlyHints)
+
+		rw.Header().Set("Content-Type", "text/html")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("<html><head></head><body></body></html>"))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.EarlyHintsPreload = true
+
+	srv := httptest.NewServer(newTestMiddleware(t, next, cfg))
+	defer srv.Close()
+
+	resp, hints := getWithInformational(t, srv.URL, "")
+
+	if len(hints) != 1 || hints[0].code != http.StatusEarlyHints {
+		t.Fatalf("expected one 103 forwarded, got %+v", hints)
+	}
+	links := strings.Join(hints[0].header.Values("Link"), ", ")
+	mustContain(t, links, "</style.css>; rel=preload; as=style", "upstream hint kept")
+	mustContain(t, links, "<"+cfg.ScriptSrc+">; rel=preload; as=script", "tracker preload added")
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected final 200, got %d", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	mustContain(t, string(body), scriptSnippet(cfg.ScriptSrc, "uuid"), "final response should be injected")
+	if strings.Contains(resp.Header.Get("Link"), cfg.ScriptSrc) {
+		t.Fatalf("tracker preload belongs to the 103 only, got final Link=%q", resp.Header.Get("Link"))
+	}
+}
+
+func Test_EarlyHints_NotAddedWhenPreloadDisabled(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		rw.WriteHeader(http.StatusEarlyHints)
+		rw.Header().Set("Content-Type", "text/html")
+		_, _ = rw.Write([]byte("<html><head></head></html>"))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+
+	srv := httptest.NewServer(newTestMiddleware(t, next, cfg))
+	defer srv.Close()
+
+	_, hints := getWithInformational(t, srv.URL, "")
+
+	if len(hints) != 1 || strings.Contains(strings.Join(hints[0].header.Values("Link"), ","), cfg.ScriptSrc) {
+		t.Fatalf("expected upstream 103 forwarded untouched, got %+v", hints)
+	}
+}
+
+func Test_EarlyHints_GeneratedForHTMLNavigations(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		_, _ = rw.Write([]byte("<html><head></head></html>"))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.SendEarlyHints = true
+
+	srv := httptest.NewServer(newTestMiddleware(t, next, cfg))
+	defer srv.Close()
+
+	resp, hints := getWithInformational(t, srv.URL, "text/html")
+	if len(hints) != 1 || hints[0].header.Get("Link") != "<"+cfg.ScriptSrc+">; rel=preload; as=script" {
+		t.Fatalf("expected generated 103 preloading the tracker, got %+v", hints)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Link") != "" {
+		t.Fatalf("expected clean final 200, got %d Link=%q", resp.StatusCode, resp.Header.Get("Link"))
+	}
+
+	_, hints = getWithInformational(t, srv.URL, "application/json")
+	if len(hints) != 0 {
+		t.Fatalf("expected no 103 for non-navigation requests, got %+v", hints)
+	}
+}
+
+// statusRecorder records the status of every WriteHeader call with the Link header it carried.
+type statusRecorder struct {
+	*httptest.ResponseRecorder
+	codes []int
+	links []string
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.codes = append(r.codes, code)
+	r.links = append(r.links, strings.Join(r.Header().Values("Link"), ", "))
+	if code >= 200 {
+		r.ResponseRecorder.WriteHeader(code)
+	}
+}
+
+func Test_EarlyHints_NotForHTTP10(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		rw.WriteHeader(http.StatusEarlyHints)
+		rw.Header().Del("Link")
+		rw.Header().Set("Content-Type", "text/html")
+		_, _ = rw.Write([]byte("<html><head></head></html>"))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.SendEarlyHints = true
+	cfg.EarlyHintsPreload = true
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.0", 1, 0
+	req.Header.Set("Accept", "text/html")
+	rr := &statusRecorder{ResponseRecorder: httptest.NewRecorder()}
+
+	newTestMiddleware(t, next, cfg).ServeHTTP(rr, req)
+
+	for i, code := range rr.codes {
+		if code == http.StatusEarlyHints && strings.Contains(rr.links[i], cfg.ScriptSrc) {
+			t.Fatalf("HTTP/1.0 clients must not get a generated or extended 103, got %v %v", rr.codes, rr.links)
+		}
+	}
+	mustContain(t, rr.Body.String(), scriptSnippet(cfg.ScriptSrc, "uuid"), "the page is still injected")
+}
+
+func trailerUpstream(contentType string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", contentType)
+		rw.Header().Set("Trailer", "X-Checksum")
+		rw.WriteHeader(http.StatusOK)
+
+		_, _ = rw.Write([]byte("<html><head></head><body>"))
+		_, _ = rw.Write([]byte("</body></html>"))
+
+		rw.Header().Set("X-Checksum", "abc123")
+		rw.Header().Set(http.TrailerPrefix+"X-Render-Time", "12ms")
+	})
+}
+
+func Test_Trailers_PreservedThroughInjection(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+
+	srv := httptest.NewServer(newTestMiddleware(t, trailerUpstream("text/html"), cfg))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	mustContain(t, string(body), scriptSnippet(cfg.ScriptSrc, "uuid"), "expected injection")
+
+	if resp.ContentLength != -1 {
+		t.Fatalf("expected chunked response to carry trailers, got Content-Length=%d", resp.ContentLength)
+	}
+	if resp.Header.Get("X-Checksum") != "" {
+		t.Fatalf("declared trailer must not be sent as a header")
+	}
+	if resp.Trailer.Get("X-Checksum") != "abc123" {
+		t.Fatalf("expected declared trailer, got %v", resp.Trailer)
+	}
+	if resp.Trailer.Get("X-Render-Time") != "12ms" {
+		t.Fatalf("expected TrailerPrefix trailer, got %v", resp.Trailer)
+	}
+}
+
+func Test_Trailers_PreservedOnPassthrough(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+
+	srv := httptest.NewServer(newTestMiddleware(t, trailerUpstream("text/plain"), cfg))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	mustNotContain(t, string(body), cfg.ScriptSrc, "text/plain is not injected")
+
+	if resp.Trailer.Get("X-Checksum") != "abc123" || resp.Trailer.Get("X-Render-Time") != "12ms" {
+		t.Fatalf("expected trailers on passthrough, got %v", resp.Trailer)
+	}
+}
+
+// signalWriter reports the first bytes reaching the client side.
+type signalWriter struct {
+	*httptest.ResponseRecorder
+
+	mu      sync.Mutex
+	arrived chan struct{}
+}
+
+func newSignalWriter() *signalWriter {
+	return &signalWriter{ResponseRecorder: httptest.NewRecorder(), arrived: make(chan struct{})}
+}
+
+func (s *signalWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ResponseRecorder.Body.Len() == 0 && len(p) > 0 {
+		close(s.arrived)
+	}
+	return s.ResponseRecorder.Write(p)
+}
+
+func (s *signalWriter) body() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.ResponseRecorder.Body.String()
+}
+
+// slowUpstream writes first, then waits until the client side has seen bytes (or gives up).
+func slowUpstream(t *testing.T, sw *signalWriter, contentType, first, rest string) http.Handler {
+	t.Helper()
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		if contentType != "" {
+			rw.Header().Set("Content-Type", contentType)
+		}
+		_, _ = rw.Write([]byte(first))
+
+		select {
+		case <-sw.arrived:
+		case <-time.After(2 * time.Second):
+			t.Errorf("first bytes were not released within the decision delay")
+		}
+
+		_, _ = rw.Write([]byte(rest))
+	})
+}
+
+func Test_DecisionDelay_ReleasesHeldInjectedOutput(t *testing.T) {
+	sw := newSignalWriter()
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.MaxDecisionDelay = "20ms"
+
+	next := slowUpstream(t, sw, "text/html", "<html><head></head>", "<body>slow</body></html>")
+	newTestMiddleware(t, next, cfg).ServeHTTP(sw, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+	want := "<html><head>" + scriptSnippet(cfg.ScriptSrc, "uuid") + "</head><body>slow</body></html>"
+	if sw.body() != want {
+		t.Fatalf("unexpected body %q", sw.body())
+	}
+	if !sw.Flushed {
+		t.Fatalf("expected the timeout to flush the original writer")
+	}
+}
+
+func Test_DecisionDelay_InjectsAtBestAnchorSoFar(t *testing.T) {
+	sw := newSignalWriter()
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.NoscriptPixel = true
+	cfg.MaxDecisionDelay = "20ms"
+
+	// The pixel waits for <body>, which arrives too late: the script alone is injected on timeout.
+	next := slowUpstream(t, sw, "text/html", "<html><head></head>", "<body>slow</body></html>")
+	newTestMiddleware(t, next, cfg).ServeHTTP(sw, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+	body := sw.body()
+	mustContain(t, body, scriptSnippet(cfg.ScriptSrc, "uuid"), "script injected on timeout")
+	mustNotContain(t, body, "<noscript>", "body anchor arrived after the decision")
+}
+
+func Test_DecisionDelay_PassesThroughUndecidedContent(t *testing.T) {
+	sw := newSignalWriter()
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.MaxDecisionDelay = "20ms"
+
+	// No Content-Type and nothing HTML-looking yet: sniffing stays undecided until the timeout.
+	next := slowUpstream(t, sw, "", "hello ", "<html><head></head></html>")
+	newTestMiddleware(t, next, cfg).ServeHTTP(sw, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+	if sw.body() != "hello <html><head></head></html>" {
+		t.Fatalf("expected untouched passthrough, got %q", sw.body())
+	}
+}
+
+func Test_DecisionDelay_HeadersSetAfterWrite_DoNotRace(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.MaxDecisionDelay = "1ms"
+
+	// The decision timer fires while the handler keeps setting headers and trailer values.
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		_, _ = rw.Write([]byte("<html><head><title>x"))
+		for i := 0; i < 200; i++ {
+			rw.Header().Set("X-T", strconv.Itoa(i))
+			rw.Header().Set(http.TrailerPrefix+"X-Done", strconv.Itoa(i))
+			time.Sleep(50 * time.Microsecond)
+		}
+		_, _ = rw.Write([]byte("</title></head><body></body></html>"))
+	})
+
+	srv := httptest.NewServer(newTestMiddleware(t, next, cfg))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	// No anchor before the timeout: the page passes through.
+	if string(body) != "<html><head><title>x</title></head><body></body></html>" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if resp.Header.Get("X-T") != "" {
+		t.Fatalf("headers set after the first write must not be sent, got %q", resp.Header.Get("X-T"))
+	}
+	if resp.Trailer.Get("X-Done") != "199" {
+		t.Fatalf("expected the last trailer value, got %v", resp.Trailer)
+	}
+}
+
+func Test_DecisionDelay_InvalidValue_IsRejected(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxDecisionDelay = "soon"
+
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Fatalf("expected error for invalid maxDecisionDelay")
+	}
+}
+
+func Test_Flush_InjectsWhenAnchorAlreadyBuffered(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		_, _ = rw.Write([]byte("<html><head><title>t</title></head>"))
+		rw.(http.Flusher).Flush()
+		_, _ = rw.Write([]byte("<body>streamed</body></html>"))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+
+	rr := httptest.NewRecorder()
+	newTestMiddleware(t, next, cfg).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+	want := "<html><head><title>t</title>" + scriptSnippet(cfg.ScriptSrc, "uuid") + "</head><body>streamed</body></html>"
+	if rr.Body.String() != want {
+		t.Fatalf("expected injection despite upstream Flush, got %q", rr.Body.String())
+	}
+}
+
+func Test_Flush_FallsBackToPassthrough_WithoutAnchor(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		_, _ = rw.Write([]byte("<html><head><title>t</title>"))
+		rw.(http.Flusher).Flush()
+		_, _ = rw.Write([]byte("</head><body></body></html>"))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+
+	rr := httptest.NewRecorder()
+	newTestMiddleware(t, next, cfg).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+	mustNotContain(t, rr.Body.String(), cfg.ScriptSrc, "no anchor at Flush time => passthrough by default")
+}
+
+func Test_Flush_PartialPrefix_KeepsSearching(t *testing.T) {
+	var flushedPrefix string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		rw.Header().Set("ETag", `"v1"`)
+		_, _ = rw.Write([]byte("<html><head><title>t</title><meta charset=utf-8></he"))
+		rw.(http.Flusher).Flush()
+		flushedPrefix = rw.(*streamWriter).orig.(*httptest.ResponseRecorder).Body.String()
+		_, _ = rw.Write([]byte("ad><body></body></html>"))
+	})
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.FlushPartialPrefix = true
+
+	rr := httptest.NewRecorder()
+	newTestMiddleware(t, next, cfg).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+	if flushedPrefix != "<html><head><title>t</title><meta charset=utf-8>" {
+		t.Fatalf("expected prefix up to the partial anchor to be flushed, got %q", flushedPrefix)
+	}
+	want := "<html><head><title>t</title><meta charset=utf-8>" + scriptSnippet(cfg.ScriptSrc, "uuid") + "</head><body></body></html>"
+	if rr.Body.String() != want {
+		t.Fatalf("expected injection after partial flush, got %q", rr.Body.String())
+	}
+	if !strings.HasPrefix(rr.Header().Get("ETag"), `W/"v1-umami-`) || rr.Header().Get("Content-Length") != "" {
+		t.Fatalf("expected injected-response headers, got %v", rr.Header())
+	}
+}
+
+func Test_Flush_PartialPrefix_DetectsScriptAcrossFlush(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.FlushPartialPrefix = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		_, _ = rw.Write([]byte(`<html><head><script defer src="https://analytics.jub`))
+		rw.(http.Flusher).Flush()
+		_, _ = rw.Write([]byte(`nl.ch/script.js"></script></head></html>`))
+	})
+
+	rr := httptest.NewRecorder()
+	newTestMiddleware(t, next, cfg).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+	if strings.Count(rr.Body.String(), cfg.ScriptSrc) != 1 {
+		t.Fatalf("expected no double injection, got %q", rr.Body.String())
+	}
+}
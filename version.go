@@ -0,0 +1,152 @@
+package traefikumamitaginjector
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxScriptSize bounds how much of the tracker is read when hashing it.
+const maxScriptSize = 4 << 20
+
+// scriptVersions pins tracker URLs to a version: a configured one, or a short hash of the
+// script's content that is refreshed every refresh interval. Refreshes happen on access, so
+// no goroutine outlives the middleware.
+type scriptVersions struct {
+	param   string
+	static  string
+	refresh time.Duration // 0 = no content hashing
+	client  *http.Client
+	now     func() time.Time
+
+	mu     sync.Mutex
+	hashes map[string]*scriptHash
+}
+
+type scriptHash struct {
+	value      string
+	fetched    time.Time
+	refreshing bool
+	ready      chan struct{} // closed after the first fetch
+}
+
+// newScriptVersions validates the script versioning settings of cfg.
+func newScriptVersions(cfg *Config, client *http.Client) (*scriptVersions, error) {
+	v := &scriptVersions{
+		param:  strings.TrimSpace(cfg.ScriptVersionParam),
+		static: strings.TrimSpace(cfg.ScriptVersion),
+		client: client,
+		now:    time.Now,
+		hashes: map[string]*scriptHash{},
+	}
+	if v.param == "" {
+		v.param = "v"
+	}
+	if raw := strings.TrimSpace(cfg.ScriptHashRefresh); raw != "" && v.static == "" {
+		refresh, err := time.ParseDuration(raw)
+		if err != nil || refresh <= 0 {
+			return nil, fmt.Errorf("invalid scriptHashRefresh %q", cfg.ScriptHashRefresh)
+		}
+		if originOf(cfg.ScriptSrc) == "" {
+			return nil, errors.New("scriptHashRefresh requires an absolute scriptSrc")
+		}
+		v.refresh = refresh
+	}
+	return v, nil
+}
+
+// version returns the version to pin src to, or "" if none is known.
+func (v *scriptVersions) version(src string) string {
+	if v == nil {
+		return ""
+	}
+	if v.static != "" {
+		return v.static
+	}
+	if v.refresh <= 0 || originOf(src) == "" {
+		return ""
+	}
+
+	v.mu.Lock()
+	h := v.hashes[src]
+	if h == nil {
+		// First use: fetch synchronously so the very first pages are pinned too.
+		h = &scriptHash{ready: make(chan struct{}), refreshing: true}
+		v.hashes[src] = h
+		v.mu.Unlock()
+
+		v.update(h, src)
+		close(h.ready)
+		return v.current(h)
+	}
+	if !h.refreshing && v.now().Sub(h.fetched) >= v.refresh {
+		h.refreshing = true
+		go v.update(h, src)
+	}
+	v.mu.Unlock()
+
+	<-h.ready
+	return v.current(h)
+}
+
+func (v *scriptVersions) current(h *scriptHash) string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return h.value
+}
+
+// update fetches src and stores its hash. A failed fetch keeps the previous value until the
+// next refresh.
+func (v *scriptVersions) update(h *scriptHash, src string) {
+	value, err := v.fetch(src)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err == nil {
+		h.value = value
+	}
+	h.fetched = v.now()
+	h.refreshing = false
+}
+
+func (v *scriptVersions) fetch(src string) (string, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, src, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching %s: %s", src, resp.Status)
+	}
+
+	sum := sha256.New()
+	if _, err := io.Copy(sum, io.LimitReader(resp.Body, maxScriptSize)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil))[:12], nil
+}
+
+// versionedSrc appends the version parameter to src.
+func versionedSrc(src, param, version string) string {
+	if version == "" {
+		return src
+	}
+	sep := "?"
+	if strings.Contains(src, "?") {
+		sep = "&"
+	}
+	return src + sep + url.QueryEscape(param) + "=" + url.QueryEscape(version)
+}
@@ -0,0 +1,146 @@
+package traefikumamitaginjector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_ScriptVersion_Static(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.ScriptVersion = "2.13.1"
+	cfg.DebugHeader = "X-Umami-Injector"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		_, _ = rw.Write([]byte("<html><head></head></html>"))
+	})
+	rr := httptest.NewRecorder()
+	newTestMiddleware(t, next, cfg).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+	mustContain(t, rr.Body.String(), scriptSnippet("https://analytics.jubnl.ch/script.js?v=2.13.1", "uuid"), "version should be appended")
+	if got := rr.Header().Get("X-Umami-Injector"); got != "inject; version=2.13.1" {
+		t.Fatalf("expected the pinned version in the debug header, got %q", got)
+	}
+}
+
+func Test_ScriptVersion_DuplicateCheckUsesBaseSrc(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.ScriptVersion = "2"
+
+	page := `<html><head><script defer src="https://analytics.jubnl.ch/script.js?v=1" data-website-id="uuid"></script></head></html>`
+	out := string(serveBytesWith(t, cfg, "text/html", []byte(page)))
+	if out != page {
+		t.Fatalf("a page carrying another version of the tracker must not get a second one, got %q", out)
+	}
+}
+
+func Test_VersionedSrc(t *testing.T) {
+	if got := versionedSrc("https://a/script.js?x=1", "ver", "a b"); got != "https://a/script.js?x=1&ver=a+b" {
+		t.Fatalf("got %q", got)
+	}
+	if got := versionedSrc("https://a/script.js", "v", ""); got != "https://a/script.js" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+// scriptStandIn serves a tracker script whose content can be changed.
+type scriptStandIn struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	content string
+	fetches int
+}
+
+func newScriptStandIn(t *testing.T, content string) *scriptStandIn {
+	t.Helper()
+
+	s := &scriptStandIn{content: content}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.fetches++
+		_, _ = io.WriteString(rw, s.content)
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *scriptStandIn) set(content string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.content = content
+}
+
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func Test_ScriptVersion_ContentHashRefresh(t *testing.T) {
+	script := newScriptStandIn(t, "console.log(1)")
+
+	var mu sync.Mutex
+	now := time.Unix(0, 0)
+	v := &scriptVersions{
+		param:   "v",
+		refresh: time.Hour,
+		client:  http.DefaultClient,
+		now: func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		},
+		hashes: map[string]*scriptHash{},
+	}
+	src := script.URL + "/script.js"
+
+	if got := v.version(src); got != contentHash("console.log(1)") {
+		t.Fatalf("expected the content hash on first use, got %q", got)
+	}
+
+	script.set("console.log(2)")
+	if got := v.version(src); got != contentHash("console.log(1)") {
+		t.Fatalf("expected the cached hash within the refresh interval, got %q", got)
+	}
+
+	mu.Lock()
+	now = now.Add(time.Hour)
+	mu.Unlock()
+	_ = v.version(src) // triggers a background refresh
+
+	deadline := time.Now().Add(2 * time.Second)
+	for v.version(src) != contentHash("console.log(2)") {
+		if time.Now().After(deadline) {
+			t.Fatalf("hash was not refreshed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	script.mu.Lock()
+	defer script.mu.Unlock()
+	if script.fetches != 2 {
+		t.Fatalf("expected exactly two fetches, got %d", script.fetches)
+	}
+}
+
+func Test_ScriptVersion_ContentHashInjected(t *testing.T) {
+	script := newScriptStandIn(t, "umami")
+
+	cfg := CreateConfig()
+	cfg.WebsiteID = "uuid"
+	cfg.ScriptSrc = script.URL + "/script.js"
+	cfg.ScriptHashRefresh = "1h"
+
+	out := string(serveBytesWith(t, cfg, "text/html", []byte("<html><head></head></html>")))
+	mustContain(t, out, scriptSnippet(cfg.ScriptSrc+"?v="+contentHash("umami"), "uuid"), "content hash should pin the script")
+}